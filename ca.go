@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files holding the CA used to intercept HTTPS requests
+const (
+	caCertFile = "chameleon-ca.pem"
+	caKeyFile  = "chameleon-ca-key.pem"
+)
+
+// CertificateAuthority issues certificates for the hosts whose HTTPS requests chameleon intercepts.
+type CertificateAuthority struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	leaves  map[string]*tls.Certificate
+	mutex   sync.Mutex
+}
+
+// caDir returns the directory to keep the CA in: dir, or chameleon's directory in the user's config directory
+// (e.g. ~/.config/chameleon) if dir is empty. Data directories are often committed to version control, so it
+// must not be inside dataDir.
+func caDir(dir, dataDir string) (string, error) {
+	if dir == "" {
+		config, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("unable to find a directory for the CA, use -ca-dir: %v", err)
+		}
+		dir = filepath.Join(config, "chameleon")
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	absData, err := filepath.Abs(dataDir)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(absData, absDir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("the CA directory %v must not be inside the data directory %v, as its key would be shared with it", dir, dataDir)
+	}
+	return dir, nil
+}
+
+// LoadOrCreateCA loads the CA from dir, generating a new one if there isn't one yet.
+// dir is created, readable only by the current user, if it doesn't exist.
+func LoadOrCreateCA(dir string) (*CertificateAuthority, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	certPEM, err := ioutil.ReadFile(certPath)
+	if os.IsNotExist(err) {
+		if err = createCA(certPath, keyPath); err != nil {
+			return nil, err
+		}
+		certPEM, err = ioutil.ReadFile(certPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA in %v: %v", dir, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA in %v: %v", dir, err)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !cert.IsCA {
+		return nil, fmt.Errorf("invalid CA in %v: not a CA certificate", dir)
+	}
+	return &CertificateAuthority{cert: cert, key: key, certPEM: certPEM, leaves: make(map[string]*tls.Certificate)}, nil
+}
+
+// createCA generates a self-signed CA, writing its certificate to certPath and its key to keyPath.
+func createCA(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "chameleon CA", Organization: []string{"chameleon"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// Write the key first, so a certificate is never left without its key
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// CertificatePEM returns the CA certificate, for clients to trust.
+func (ca *CertificateAuthority) CertificatePEM() []byte {
+	return ca.certPEM
+}
+
+// Certificate returns a certificate for host (a name or an IP address) signed by the CA,
+// generating it on first use.
+func (ca *CertificateAuthority) Certificate(host string) (*tls.Certificate, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if leaf, ok := ca.leaves[host]; ok {
+		return leaf, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host, Organization: []string{"chameleon"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		// Clients reject leaf certificates valid for longer than 825 days
+		NotAfter:    time.Now().AddDate(1, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf := &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}
+	ca.leaves[host] = leaf
+	return leaf, nil
+}
+
+// CAHandler serves the CA certificate, for clients to download and trust.
+func CAHandler(ca *CertificateAuthority) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			w.WriteHeader(405)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		// If this fails, there isn't much to do
+		_, _ = w.Write(ca.CertificatePEM())
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+
+	ca, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, caKeyFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Got: `%v` (%v); Expected: `%v`", info, err, os.FileMode(0600))
+	}
+
+	loaded, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if !bytes.Equal(loaded.CertificatePEM(), ca.CertificatePEM()) {
+		t.Errorf("A new CA was created instead of loading the existing one")
+	}
+}
+
+func TestLoadOrCreateCAInvalid(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, caCertFile), []byte("not a certificate"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, caKeyFile), []byte("not a key"), 0600)
+
+	if _, err := LoadOrCreateCA(dir); err == nil {
+		t.Errorf("Got: `%v`; Expected an error", err)
+	}
+}
+
+func TestCertificateAuthorityCertificate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	ca, _ := LoadOrCreateCA(dir)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertificatePEM())
+
+	for _, host := range []string{"api.example.com", "127.0.0.1"} {
+		leaf, err := ca.Certificate(host)
+		if err != nil {
+			t.Fatalf("Unexpected error: `%v`", err)
+		}
+		cert, _ := x509.ParseCertificate(leaf.Certificate[0])
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("Got: `%v`; Expected a certificate valid for `%v`", err, host)
+		}
+
+		again, _ := ca.Certificate(host)
+		if again != leaf {
+			t.Errorf("A new certificate was issued for `%v` instead of reusing the first", host)
+		}
+	}
+}
+
+func TestCAHandler(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	ca, _ := LoadOrCreateCA(dir)
+
+	w := httptest.NewRecorder()
+	CAHandler(ca).ServeHTTP(w, httptest.NewRequest("GET", "/_ca.pem", nil))
+	if !bytes.Equal(w.Body.Bytes(), ca.CertificatePEM()) {
+		t.Errorf("Got: `%v`; Expected: `%v`", w.Body.String(), string(ca.CertificatePEM()))
+	}
+
+	w = httptest.NewRecorder()
+	CAHandler(ca).ServeHTTP(w, httptest.NewRequest("POST", "/_ca.pem", nil))
+	if w.Code != 405 {
+		t.Errorf("Got: `%v`; Expected: `%v`", w.Code, 405)
+	}
+}
+
+func TestCADir(t *testing.T) {
+	tests := []struct {
+		dir     string
+		dataDir string
+		valid   bool
+	}{
+		{"/home/me/.config/chameleon", "./recordings", true},
+		{"./recordings-ca", "./recordings", true},
+		{"./recordings", "./recordings", false},
+		{"./recordings/ca", "./recordings", false},
+		{"recordings/../recordings/ca", "./recordings/", false},
+	}
+
+	for _, test := range tests {
+		dir, err := caDir(test.dir, test.dataDir)
+		if (err == nil) != test.valid || (err == nil && dir != test.dir) {
+			t.Errorf("Got: `%v` (%v); Expected `%v` to be allowed: `%v`", dir, err, test.dir, test.valid)
+		}
+	}
+}
+
+func TestCADirDefault(t *testing.T) {
+	config, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(config)
+	defer os.Setenv("XDG_CONFIG_HOME", os.Getenv("XDG_CONFIG_HOME"))
+	os.Setenv("XDG_CONFIG_HOME", config)
+
+	dir, err := caDir("", "./recordings")
+	if err != nil && runtime.GOOS == "linux" {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if expected := filepath.Join(config, "chameleon"); runtime.GOOS == "linux" && dir != expected {
+		t.Errorf("Got: `%v`; Expected: `%v`", dir, expected)
+	}
+}
+
+func TestLoadOrCreateCACreatesDir(t *testing.T) {
+	parent, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "config", "chameleon")
+
+	if _, err := LoadOrCreateCA(dir); err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Got: `%v` (%v); Expected: `%v`", info, err, os.ModeDir|0700)
+	}
+}
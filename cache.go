@@ -1,12 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"net/http/httptest"
+	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // CachedResponse respresents a response to be cached.
@@ -14,13 +26,34 @@ type CachedResponse struct {
 	StatusCode int
 	Body       []byte
 	Headers    map[string]string
+	Seeded     bool
+	Events     []EventTiming
+	Frames     []WebSocketFrame
+	Latency    *Latency
+	Encoding   string
+	// open streams the body from disk, instead of holding it in Body
+	open func() (io.ReadCloser, error)
+}
+
+// BodyReader returns a reader for the body of the response, which may be streamed from disk.
+func (r *CachedResponse) BodyReader() (io.ReadCloser, error) {
+	if r.open != nil {
+		return r.open()
+	}
+	return ioutil.NopCloser(bytes.NewReader(r.Body)), nil
 }
 
 // SpecResponse represents a specification for a response.
 type SpecResponse struct {
 	StatusCode  int               `json:"status_code"`
 	ContentFile string            `json:"content"`
+	Compression string            `json:"compression,omitempty"`
 	Headers     map[string]string `json:"headers"`
+	Events      []EventTiming     `json:"events,omitempty"`
+	Frames      []WebSocketFrame  `json:"frames,omitempty"`
+	Latency     *Latency          `json:"latency,omitempty"`
+	// Encoding is the Content-Encoding upstream sent the body with; the body is stored decoded
+	Encoding string `json:"encoding,omitempty"`
 }
 
 // Spec represents a full specification to describe a response and how to look up its index.
@@ -33,14 +66,23 @@ type Spec struct {
 type FileSystem interface {
 	WriteFile(path string, content []byte) error
 	ReadFile(path string) ([]byte, error)
+	Open(path string) (io.ReadCloser, error)
+	Create(path string) (io.WriteCloser, error)
+	ListFiles(dir string) ([]string, error)
+	Remove(path string) error
+	Rename(oldPath, newPath string) error
 }
 
 // DefaultFileSystem provides a default implementation of a filesystem on disk.
 type DefaultFileSystem struct {
 }
 
-// WriteFile writes content to disk at path.
+// WriteFile writes content to disk at path, creating any missing directories.
 func (fs DefaultFileSystem) WriteFile(path string, content []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
 	return ioutil.WriteFile(path, content, 0644)
 }
 
@@ -49,123 +91,440 @@ func (fs DefaultFileSystem) ReadFile(path string) ([]byte, error) {
 	return ioutil.ReadFile(path)
 }
 
+// Open opens the file at path for reading.
+func (fs DefaultFileSystem) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+// ListFiles returns the slash-separated paths of every file under dir, relative to dir.
+func (fs DefaultFileSystem) ListFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// Create creates (or truncates) the file at path for writing, creating any missing directories.
+func (fs DefaultFileSystem) Create(path string) (io.WriteCloser, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// Remove deletes the file at path.
+func (fs DefaultFileSystem) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// Rename moves the file at oldPath to newPath, replacing any file already there and creating any missing directories.
+func (fs DefaultFileSystem) Rename(oldPath, newPath string) error {
+	err := os.MkdirAll(filepath.Dir(newPath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// A Recording is a response streamed from upstream, to be stored by a Cacher.
+type Recording struct {
+	StatusCode int
+	Header     http.Header
+	Body       io.Reader
+	// Events holds the timing of each event in text/event-stream responses
+	Events []EventTiming
+	// Frames holds the frames sent over WebSocket connections
+	Frames []WebSocketFrame
+	// Latency is how long upstream took to respond
+	Latency *Latency
+	// Encoding is the Content-Encoding the body was decoded from, if any
+	Encoding string
+}
+
 // A Cacher interface is used to provide a mechanism of storage for a given request and response.
 type Cacher interface {
 	Get(key string) *CachedResponse
 	Put(key string, r *httptest.ResponseRecorder) *CachedResponse
+	Record(key string, rec *Recording) (*CachedResponse, error)
 }
 
 // DiskCacher is the default cacher which writes to disk
 type DiskCacher struct {
-	cache    map[string]*CachedResponse
-	dataDir  string
-	specPath string
-	mutex    *sync.RWMutex
+	cache      map[string]*CachedResponse
+	dataDir    string
+	specPath   string
+	usagePath  string
+	mutex      *sync.RWMutex
+	usage      map[string]*Usage
+	usageMutex *sync.Mutex
+	started    time.Time
 	FileSystem
+	// Strict refuses to load a data directory with any invalid entries, rather than skipping them.
+	Strict bool
+	// Sharded writes new content files in nested directories (e.g. `ab/cd/abcdef...`) instead of directly in the data directory.
+	Sharded bool
+	// Compression is used to compress new content files, e.g. "gzip". The default is no compression.
+	Compression string
+	// Lazy only keeps spec.json in memory and streams bodies from disk when they are requested.
+	// Up to LazyCacheSize bytes of recently requested bodies are kept in memory.
+	Lazy          bool
+	LazyCacheSize int64
+	bodies        *bodyCache
+	// generation counts the changes to the cache and data directory, so SeedCache can tell if one raced with it
+	generation uint64
+	// own tracks the files the cacher changed itself, while it is watched
+	own *ownFiles
 }
 
 // NewDiskCacher creates a new disk cacher for a given data directory.
-func NewDiskCacher(dataDir string) DiskCacher {
-	return DiskCacher{
+func NewDiskCacher(dataDir string) *DiskCacher {
+	return &DiskCacher{
 		cache:      make(map[string]*CachedResponse),
 		dataDir:    dataDir,
 		specPath:   path.Join(dataDir, "spec.json"),
+		usagePath:  path.Join(dataDir, "usage.json"),
 		mutex:      new(sync.RWMutex),
+		usage:      make(map[string]*Usage),
+		usageMutex: new(sync.Mutex),
+		own:        new(ownFiles),
+		started:    time.Now(),
 		FileSystem: DefaultFileSystem{},
 	}
 }
 
 // SeedCache populates the DiskCacher with entries from disk.
-func (c *DiskCacher) SeedCache() {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// The entries are read in full before being swapped in, so a failed load leaves the cache untouched.
+// Preseeded responses only live in memory and are kept unless the disk now has an entry for the same key.
+//
+// Invalid entries are returned as SpecErrors. In strict mode, the cache is left untouched when there are any;
+// otherwise the invalid entries are skipped and the remaining entries are loaded.
+func (c *DiskCacher) SeedCache() error {
+	for {
+		// Reading the data directory may take a while, so requests are only held up while the entries are swapped in
+		c.mutex.RLock()
+		generation := c.generation
+		c.mutex.RUnlock()
+
+		var bodies *bodyCache
+		if c.Lazy && c.LazyCacheSize > 0 {
+			// Bodies may have been edited, so start with an empty cache
+			bodies = newBodyCache(c.LazyCacheSize)
+		}
+		cache, problems, err := c.readCache(bodies)
 
-	specs := c.loadSpecs()
+		c.mutex.Lock()
+		if c.generation != generation {
+			// The cacher changed the data directory while it was read, so read it again
+			c.mutex.Unlock()
+			continue
+		}
+		defer c.mutex.Unlock()
 
-	for _, spec := range specs {
-		body, err := c.FileSystem.ReadFile(path.Join(c.dataDir, spec.SpecResponse.ContentFile))
 		if err != nil {
-			panic(err)
+			return err
 		}
-		response := &CachedResponse{
-			StatusCode: spec.StatusCode,
-			Headers:    spec.Headers,
-			Body:       body,
+		if len(problems) > 0 && c.Strict {
+			return problems
+		}
+		c.bodies = bodies
+
+		for key, response := range c.cache {
+			if _, ok := cache[key]; response.Seeded && !ok {
+				cache[key] = response
+			}
 		}
-		c.cache[spec.Key] = response
+		c.cache = cache
+
+		if len(problems) > 0 {
+			return problems
+		}
+		return nil
+	}
+}
+
+// Reload re-reads the data directory, replacing the entries in the cache.
+// Outside of strict mode, invalid entries are logged and skipped.
+func (c *DiskCacher) Reload() error {
+	err := c.SeedCache()
+	if problems, ok := err.(SpecErrors); ok && !c.Strict {
+		log.Printf("Skipping invalid entries in %v:\n%v\n", c.dataDir, problems)
+		return nil
 	}
+	return err
 }
 
 // Get fetches a CachedResponse for a given key
-func (c DiskCacher) Get(key string) *CachedResponse {
+func (c *DiskCacher) Get(key string) *CachedResponse {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
-	return c.cache[key]
+	response := c.cache[key]
+	if response != nil {
+		c.touch(key)
+	}
+	return response
+}
+
+func (c *DiskCacher) readCache(bodies *bodyCache) (map[string]*CachedResponse, SpecErrors, error) {
+	specs, problems, err := c.readSpecs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cache := make(map[string]*CachedResponse)
+	seen := make(map[string]int)
+	for i, spec := range specs {
+		if spec == nil {
+			continue
+		}
+		if msg := validateSpec(spec); msg != "" {
+			problems = append(problems, &SpecError{Index: i, Key: spec.Key, Msg: msg})
+			continue
+		}
+		if first, ok := seen[spec.Key]; ok {
+			msg := fmt.Sprintf("duplicate key, first defined by entry %d", first)
+			problems = append(problems, &SpecError{Index: i, Key: spec.Key, Msg: msg})
+			continue
+		}
+		seen[spec.Key] = i
+
+		response := &CachedResponse{
+			StatusCode: spec.StatusCode,
+			Headers:    spec.Headers,
+			Events:     spec.Events,
+			Frames:     spec.Frames,
+			Latency:    spec.Latency,
+			Encoding:   spec.Encoding,
+		}
+		if c.Lazy {
+			// Only check that the content file exists
+			var file io.ReadCloser
+			file, err = c.openContent(spec.SpecResponse.ContentFile)
+			if err == nil {
+				_ = file.Close()
+				response.open = c.lazyBody(spec.SpecResponse.ContentFile, spec.Compression, bodies)
+			}
+		} else {
+			response.Body, err = c.readContent(spec.SpecResponse.ContentFile)
+			if err == nil {
+				response.Body, err = decompressContent(response.Body, spec.Compression)
+			}
+		}
+		if err != nil {
+			problems = append(problems, &SpecError{Index: i, Key: spec.Key, Msg: err.Error()})
+			continue
+		}
+		cache[spec.Key] = response
+	}
+	return cache, problems, nil
 }
 
-func (c DiskCacher) loadSpecs() []Spec {
+func (c *DiskCacher) readSpecContent() []byte {
 	specContent, err := c.FileSystem.ReadFile(c.specPath)
 	if err != nil {
-		specContent = []byte{'[', ']'}
+		return []byte{'[', ']'}
 	}
+	return specContent
+}
 
-	var specs []Spec
-	err = json.Unmarshal(specContent, &specs)
+func (c *DiskCacher) readSpecs() ([]*Spec, SpecErrors, error) {
+	return parseSpecs(c.specPath, c.readSpecContent())
+}
+
+// writeRawSpecs replaces the entries in spec.json.
+func (c *DiskCacher) writeRawSpecs(specs []json.RawMessage) error {
+	if specs == nil {
+		specs = []json.RawMessage{}
+	}
+	specBytes, err := json.MarshalIndent(specs, "", "    ")
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return c.writeFile("spec.json", specBytes)
+}
+
+// writeFile writes a file in the data directory, as a change of the cacher's own.
+func (c *DiskCacher) writeFile(name string, content []byte) error {
+	p := path.Join(c.dataDir, name)
+	return c.own.track(p, func() error {
+		return c.FileSystem.WriteFile(p, content)
+	})
+}
 
-	return specs
+// flattenHeaders joins the values of each header, as they are stored in spec.json.
+func flattenHeaders(header http.Header) map[string]string {
+	specHeaders := make(map[string]string)
+	for k, v := range header {
+		specHeaders[k] = strings.Join(v, ", ")
+	}
+	return specHeaders
 }
 
 // Put stores a CachedResponse for a given key and response
-func (c DiskCacher) Put(key string, resp *httptest.ResponseRecorder) *CachedResponse {
+func (c *DiskCacher) Put(key string, resp *httptest.ResponseRecorder) *CachedResponse {
+	skipDisk := resp.Header().Get("_chameleon-seeded-skip-disk") != ""
+	if !skipDisk {
+		response, err := c.Record(key, &Recording{StatusCode: resp.Code, Header: resp.Header(), Body: resp.Body})
+		if err != nil {
+			panic(err)
+		}
+		return response
+	}
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	c.generation++
 
-	skipDisk := resp.Header().Get("_chameleon-seeded-skip-disk") != ""
-	if skipDisk {
-		resp.Header().Del("_chameleon-seeded-skip-disk")
+	resp.Header().Del("_chameleon-seeded-skip-disk")
+	c.cache[key] = &CachedResponse{
+		StatusCode: resp.Code,
+		Headers:    flattenHeaders(resp.Header()),
+		Body:       resp.Body.Bytes(),
+		Seeded:     true,
 	}
+	c.touch(key)
 
-	specHeaders := make(map[string]string)
-	for k, v := range resp.Header() {
-		specHeaders[k] = strings.Join(v, ", ")
+	return c.cache[key]
+}
+
+// tempCounter makes the names of temporary content files unique
+var tempCounter uint64
+
+// writeContent streams body into a new content file, named after its content.
+// The uncompressed body is also copied to memory, if it isn't nil.
+func (c *DiskCacher) writeContent(body io.Reader, memory io.Writer) (string, error) {
+	tempFile := path.Join(c.dataDir, fmt.Sprintf(".chameleon-%d-%d.tmp", os.Getpid(), atomic.AddUint64(&tempCounter, 1)))
+	file, err := c.FileSystem.Create(tempFile)
+	if err != nil {
+		return "", err
 	}
 
-	if !skipDisk {
-		specs := c.loadSpecs()
+	var content io.Writer = file
+	var gz *gzip.Writer
+	if c.Compression == gzipCompression {
+		gz = gzip.NewWriter(file)
+		content = gz
+	}
+	hasher := sha256.New()
+	writers := []io.Writer{content, hasher}
+	if memory != nil {
+		writers = append(writers, memory)
+	}
 
-		newSpec := Spec{
-			Key: key,
-			SpecResponse: SpecResponse{
-				StatusCode:  resp.Code,
-				ContentFile: key,
-				Headers:     specHeaders,
-			},
-		}
+	_, err = io.Copy(io.MultiWriter(writers...), body)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = c.FileSystem.Remove(tempFile)
+		return "", err
+	}
 
-		specs = append(specs, newSpec)
+	// Identical content always has the same name, so it is only ever stored once
+	name := compressedName(hex.EncodeToString(hasher.Sum(nil)), c.Compression)
+	contentFile := layoutName(name, c.Sharded)
+	target := path.Join(c.dataDir, contentFile)
+	err = c.own.track(target, func() error {
+		return c.FileSystem.Rename(tempFile, target)
+	})
+	if err != nil {
+		_ = c.FileSystem.Remove(tempFile)
+		return "", err
+	}
+	return contentFile, nil
+}
 
-		contentFilePath := path.Join(c.dataDir, key)
-		err := c.FileSystem.WriteFile(contentFilePath, resp.Body.Bytes())
-		if err != nil {
-			panic(err)
+// replaceSpec replaces the entry for key in specs with spec, or adds spec if there isn't one.
+// Concurrent misses for the same key each record the response, and the last one wins.
+func replaceSpec(specs []json.RawMessage, key string, spec json.RawMessage) []json.RawMessage {
+	for i, raw := range specs {
+		var existing struct {
+			Key string `json:"key"`
 		}
-
-		specBytes, err := json.MarshalIndent(specs, "", "    ")
-		err = c.FileSystem.WriteFile(c.specPath, specBytes)
-		if err != nil {
-			panic(err)
+		if json.Unmarshal(raw, &existing) == nil && existing.Key == key {
+			specs[i] = spec
+			return specs
 		}
 	}
+	return append(specs, spec)
+}
 
-	c.cache[key] = &CachedResponse{
-		StatusCode: resp.Code,
+// Record stores a response streamed from upstream for a given key.
+// The body is streamed to disk, and only kept in memory if the cacher isn't lazy.
+func (c *DiskCacher) Record(key string, rec *Recording) (*CachedResponse, error) {
+	var memory bytes.Buffer
+	var copyTo io.Writer
+	if !c.Lazy {
+		copyTo = &memory
+	}
+	contentFile, err := c.writeContent(rec.Body, copyTo)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+
+	var specs []json.RawMessage
+	specContent := c.readSpecContent()
+	err = json.Unmarshal(specContent, &specs)
+	if err != nil {
+		return nil, jsonError(c.specPath, specContent, 0, err)
+	}
+
+	specHeaders := flattenHeaders(rec.Header)
+	newSpec, err := json.Marshal(Spec{
+		Key: key,
+		SpecResponse: SpecResponse{
+			StatusCode:  rec.StatusCode,
+			ContentFile: contentFile,
+			Compression: c.Compression,
+			Headers:     specHeaders,
+			Events:      rec.Events,
+			Frames:      rec.Frames,
+			Latency:     rec.Latency,
+			Encoding:    rec.Encoding,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = c.writeRawSpecs(replaceSpec(specs, key, newSpec))
+	if err != nil {
+		return nil, err
+	}
+
+	response := &CachedResponse{
+		StatusCode: rec.StatusCode,
 		Headers:    specHeaders,
-		Body:       resp.Body.Bytes(),
+		Events:     rec.Events,
+		Frames:     rec.Frames,
+		Latency:    rec.Latency,
+		Encoding:   rec.Encoding,
+	}
+	if c.Lazy {
+		response.open = c.lazyBody(contentFile, c.Compression, c.bodies)
+	} else {
+		response.Body = memory.Bytes()
 	}
+	c.cache[key] = response
+	c.touch(key)
 
-	return c.cache[key]
+	return response, nil
 }
@@ -2,13 +2,25 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http/httptest"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 )
 
+// contentName returns the name of the content file for body, which is the hex SHA-256 of body.
+func contentName(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
 type mockFileSystem struct {
 }
 
@@ -16,6 +28,38 @@ func (fs mockFileSystem) WriteFile(path string, content []byte) error {
 	return nil
 }
 
+func (fs mockFileSystem) ListFiles(dir string) ([]string, error) {
+	return []string{"spec.json", "key"}, nil
+}
+
+func (fs mockFileSystem) Open(path string) (io.ReadCloser, error) {
+	content, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (fs mockFileSystem) Create(path string) (io.WriteCloser, error) {
+	return nopWriteCloser{ioutil.Discard}, nil
+}
+
+func (fs mockFileSystem) Remove(path string) error {
+	return nil
+}
+
+func (fs mockFileSystem) Rename(oldPath, newPath string) error {
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
 func (fs mockFileSystem) ReadFile(path string) ([]byte, error) {
 	if strings.HasSuffix(path, "-error") {
 		return nil, fmt.Errorf("SOMETHING BROKE")
@@ -107,3 +151,259 @@ func TestDiskCacherPutSkipDiskSeeded(t *testing.T) {
 		t.Errorf("Unexpected header `_chameleon-seeded-skip-disk`")
 	}
 }
+
+func TestDiskCacherSeedCacheKeepsSeeded(t *testing.T) {
+	cacher := NewDiskCacher("")
+	cacher.FileSystem = mockFileSystem{}
+	_ = cacher.SeedCache()
+
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("_chameleon-seeded-skip-disk", "true")
+	_ = cacher.Put("seeded_key", recorder)
+
+	err := cacher.SeedCache()
+	if err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+	if cacher.Get("seeded_key") == nil {
+		t.Errorf("Seeded response was dropped on reload")
+	}
+	if cacher.Get("key") == nil {
+		t.Errorf("Response from disk was dropped on reload")
+	}
+}
+
+func TestDiskCacherSeedCacheBadSpecs(t *testing.T) {
+	cacher := NewDiskCacher("")
+	cacher.FileSystem = mockFileSystem{}
+	_ = cacher.SeedCache()
+
+	cacher.FileSystem = badSpecFileSystem{}
+	err := cacher.SeedCache()
+	if err == nil {
+		t.Errorf("Expected an error for malformed specs")
+	}
+	if cacher.Get("key") == nil {
+		t.Errorf("Cache was modified by a failed reload")
+	}
+}
+
+type badSpecFileSystem struct {
+	mockFileSystem
+}
+
+func (fs badSpecFileSystem) ReadFile(path string) ([]byte, error) {
+	return []byte("NOT JSON"), nil
+}
+
+type mapFileSystem map[string][]byte
+
+func (fs mapFileSystem) WriteFile(path string, content []byte) error {
+	fs[path] = content
+	return nil
+}
+
+func (fs mapFileSystem) ListFiles(dir string) ([]string, error) {
+	var files []string
+	for name := range fs {
+		if rel, err := filepath.Rel(dir, name); err == nil && !strings.HasPrefix(rel, "..") {
+			files = append(files, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (fs mapFileSystem) Open(path string) (io.ReadCloser, error) {
+	content, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (fs mapFileSystem) Create(path string) (io.WriteCloser, error) {
+	return &mapFile{fs: fs, path: path}, nil
+}
+
+// mapFile is written to a mapFileSystem when it is closed.
+type mapFile struct {
+	bytes.Buffer
+	fs   mapFileSystem
+	path string
+}
+
+func (f *mapFile) Close() error {
+	f.fs[f.path] = f.Bytes()
+	return nil
+}
+
+func (fs mapFileSystem) Rename(oldPath, newPath string) error {
+	content, ok := fs[oldPath]
+	if !ok {
+		return fmt.Errorf("rename %v: no such file or directory", oldPath)
+	}
+	delete(fs, oldPath)
+	fs[newPath] = content
+	return nil
+}
+
+func (fs mapFileSystem) Remove(path string) error {
+	if _, ok := fs[path]; !ok {
+		return fmt.Errorf("remove %v: no such file or directory", path)
+	}
+	delete(fs, path)
+	return nil
+}
+
+func (fs mapFileSystem) ReadFile(path string) ([]byte, error) {
+	content, ok := fs[path]
+	if !ok {
+		return nil, fmt.Errorf("open %v: no such file or directory", path)
+	}
+	return content, nil
+}
+
+var invalidSpecs = []byte(`[
+    {"key": "good", "response": {"status_code": 200, "content": "good"}},
+    {"key": "missing", "response": {"status_code": 200, "content": "missing"}},
+    {"key": "good", "response": {"status_code": 201, "content": "good"}},
+    {"key": "status", "response": {"status_code": 42, "content": "good"}}
+]`)
+
+func TestDiskCacherSeedCacheInvalidEntries(t *testing.T) {
+	cacher := NewDiskCacher("")
+	cacher.FileSystem = mapFileSystem{"spec.json": invalidSpecs, "good": []byte("GOOD")}
+
+	err := cacher.SeedCache()
+	problems, ok := err.(SpecErrors)
+	if !ok {
+		t.Fatalf("Got: `%v`; Expected SpecErrors", err)
+	}
+	if len(problems) != 3 {
+		t.Errorf("Got: `%v` problems; Expected: `3`\n%v", len(problems), problems)
+	}
+	if response := cacher.Get("good"); response == nil || response.StatusCode != 200 {
+		t.Errorf("Valid entry was not loaded")
+	}
+	if len(cacher.cache) != 1 {
+		t.Errorf("Got: `%v`; Expected: `1`", len(cacher.cache))
+	}
+}
+
+func TestDiskCacherSeedCacheStrict(t *testing.T) {
+	cacher := NewDiskCacher("")
+	cacher.FileSystem = mapFileSystem{"spec.json": invalidSpecs, "good": []byte("GOOD")}
+	cacher.Strict = true
+
+	err := cacher.SeedCache()
+	if _, ok := err.(SpecErrors); !ok {
+		t.Fatalf("Got: `%v`; Expected SpecErrors", err)
+	}
+	if len(cacher.cache) != 0 {
+		t.Errorf("Got: `%v`; Expected: `0`", len(cacher.cache))
+	}
+	if cacher.Reload() == nil {
+		t.Errorf("Expected reload to fail in strict mode")
+	}
+}
+
+func TestDiskCacherReloadSkipsInvalidEntries(t *testing.T) {
+	cacher := NewDiskCacher("")
+	cacher.FileSystem = mapFileSystem{"spec.json": invalidSpecs, "good": []byte("GOOD")}
+
+	err := cacher.Reload()
+	if err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+	if cacher.Get("good") == nil {
+		t.Errorf("Valid entry was not loaded")
+	}
+}
+
+func TestDiskCacherPutKeepsInvalidEntries(t *testing.T) {
+	fs := mapFileSystem{"spec.json": invalidSpecs, "good": []byte("GOOD")}
+	cacher := NewDiskCacher("")
+	cacher.FileSystem = fs
+	_ = cacher.SeedCache()
+
+	recorder := httptest.NewRecorder()
+	recorder.Code = 200
+	_ = cacher.Put("new_key", recorder)
+
+	specs, _, _ := parseSpecs("spec.json", fs["spec.json"])
+	if len(specs) != 5 {
+		t.Errorf("Got: `%v` entries; Expected: `5`", len(specs))
+	}
+}
+
+func TestDiskCacherPutDeduplicatesContent(t *testing.T) {
+	fs := mapFileSystem{}
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+
+	for _, key := range []string{"first", "second"} {
+		recorder := httptest.NewRecorder()
+		recorder.Code = 200
+		_, _ = recorder.WriteString("SAME BODY")
+		_ = cacher.Put(key, recorder)
+	}
+
+	name := contentName([]byte("SAME BODY"))
+	if len(name) != 64 {
+		t.Errorf("Got: `%v`; Expected a hex SHA-256", name)
+	}
+	if string(fs["data/"+name]) != "SAME BODY" {
+		t.Errorf("Content file `%v` was not written", name)
+	}
+	if len(fs) != 2 {
+		t.Errorf("Got: `%v` files; Expected: `2` (spec.json and one content file)", len(fs))
+	}
+
+	specs, _, _ := parseSpecs("spec.json", fs["data/spec.json"])
+	for _, spec := range specs {
+		if spec.ContentFile != name {
+			t.Errorf("Got: `%v`; Expected: `%v`", spec.ContentFile, name)
+		}
+	}
+}
+
+// racingFileSystem calls race the first time spec.json is read.
+type racingFileSystem struct {
+	mapFileSystem
+	race func()
+}
+
+func (fs *racingFileSystem) ReadFile(path string) ([]byte, error) {
+	if race := fs.race; race != nil && path == "spec.json" {
+		fs.race = nil
+		race()
+	}
+	return fs.mapFileSystem.ReadFile(path)
+}
+
+func TestDiskCacherSeedCacheRacingRecord(t *testing.T) {
+	fs := &racingFileSystem{mapFileSystem: mapFileSystem{
+		"spec.json": []byte(`[{"key": "old", "response": {"status_code": 200, "content": "old"}}]`),
+		"old":       []byte("OLD"),
+	}}
+	cacher := NewDiskCacher("")
+	cacher.FileSystem = fs
+	_ = cacher.SeedCache()
+
+	// Requests are served and recorded while the data directory is read
+	fs.race = func() {
+		if cacher.Get("old") == nil {
+			t.Errorf("Existing entry was not served during the reload")
+		}
+		if _, err := cacher.Record("new", &Recording{StatusCode: 200, Body: strings.NewReader("NEW")}); err != nil {
+			t.Errorf("Unexpected error: `%v`", err)
+		}
+	}
+	if err := cacher.SeedCache(); err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if response := cacher.Get("new"); response == nil || string(response.Body) != "NEW" {
+		t.Errorf("Got: `%v`; Expected the entry recorded during the reload", response)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultClient sends requests to the proxied service when ProxyOptions has no Client.
+var defaultClient = &http.Client{CheckRedirect: passRedirect}
+
+// passRedirect stops a client from following redirects, so they are passed on to (and recorded for) the client.
+func passRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// UpstreamConfig configures the connections chameleon makes to the services it proxies.
+type UpstreamConfig struct {
+	// ConnectTimeout limits how long connecting, including the TLS handshake, may take. Zero means no limit.
+	ConnectTimeout time.Duration
+	// ResponseTimeout limits how long to wait for the response headers once a request has been sent.
+	// Reading the body isn't limited, so long streamed responses aren't cut off. Zero means no limit.
+	ResponseTimeout time.Duration
+	// CAFile is a PEM bundle of certificate authorities to trust as well as the system ones
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and key, for services which require mutual TLS
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify accepts any certificate from the service, e.g. a self-signed one on a staging server
+	InsecureSkipVerify bool
+	// Proxy is the URL of a proxy to send requests through. If empty, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used.
+	Proxy string
+	// FollowRedirects follows redirects from the service, recording the final response under the original request.
+	// By default, redirects are passed on to the client as they are.
+	FollowRedirects bool
+}
+
+// TLSConfig returns the TLS configuration for connecting to the services.
+func (c UpstreamConfig) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		bundle, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %v", c.CAFile)
+		}
+		config.RootCAs = roots
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Transport returns a transport connecting to the services as configured. It keeps connections open
+// for reuse, so it should be shared by every request.
+func (c UpstreamConfig) Transport() (*http.Transport, error) {
+	config, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: c.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = c.ConnectTimeout
+	transport.ResponseHeaderTimeout = c.ResponseTimeout
+	transport.TLSClientConfig = config
+	if c.Proxy != "" {
+		proxyURL, err := url.Parse(c.Proxy)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid upstream proxy %q: expected an absolute URL (e.g. http://proxy:3128)", c.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport, nil
+}
+
+// Client returns a client sending requests to the services as configured.
+func (c UpstreamConfig) Client() (*http.Client, error) {
+	transport, err := c.Transport()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: transport}
+	if !c.FollowRedirects {
+		client.CheckRedirect = passRedirect
+	}
+	return client, nil
+}
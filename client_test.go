@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tlsServer(clientAuth tls.ClientAuthType) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, TLS!"))
+	}))
+	server.TLS = &tls.Config{ClientAuth: clientAuth}
+	server.StartTLS()
+	return server
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	return file
+}
+
+func getWith(config UpstreamConfig, url string) error {
+	client, err := config.Client()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestUpstreamConfigCA(t *testing.T) {
+	server := tlsServer(tls.NoClientCert)
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+
+	if err := getWith(UpstreamConfig{}, server.URL); err == nil {
+		t.Errorf("Got: `%v`; Expected the self-signed certificate to be rejected", err)
+	}
+	if err := getWith(UpstreamConfig{CAFile: caFile}, server.URL); err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+	if err := getWith(UpstreamConfig{InsecureSkipVerify: true}, server.URL); err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+}
+
+func TestUpstreamConfigInvalidCA(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	_ = ioutil.WriteFile(caFile, []byte("not a certificate"), 0644)
+
+	if _, err := (UpstreamConfig{CAFile: caFile}).Client(); err == nil {
+		t.Errorf("Got: `%v`; Expected an error", err)
+	}
+}
+
+func TestUpstreamConfigClientCertificate(t *testing.T) {
+	server := tlsServer(tls.RequireAnyClientCert)
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+
+	cert, _ := selfSignedCertificate([]string{"client"})
+	keyDER, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	certFile := writePEM(t, dir, "client.pem", "CERTIFICATE", cert.Certificate[0])
+	keyFile := writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+
+	if err := getWith(UpstreamConfig{InsecureSkipVerify: true}, server.URL); err == nil {
+		t.Errorf("Got: `%v`; Expected the request without a client certificate to fail", err)
+	}
+	config := UpstreamConfig{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}
+	if err := getWith(config, server.URL); err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+}
+
+func TestUpstreamConfigResponseTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	if err := getWith(UpstreamConfig{ResponseTimeout: 10 * time.Millisecond}, server.URL); err == nil {
+		t.Errorf("Got: `%v`; Expected a timeout", err)
+	}
+	if err := getWith(UpstreamConfig{ResponseTimeout: time.Second}, server.URL); err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+}
+
+func TestUpstreamConfigProxy(t *testing.T) {
+	requested := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.URL.String()
+	}))
+	defer proxy.Close()
+
+	if err := getWith(UpstreamConfig{Proxy: proxy.URL}, "http://api.example.com/orders"); err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if got := <-requested; got != "http://api.example.com/orders" {
+		t.Errorf("Got: `%v`; Expected: `%v`", got, "http://api.example.com/orders")
+	}
+
+	if _, err := (UpstreamConfig{Proxy: "proxy:3128"}).Client(); err == nil {
+		t.Errorf("Got: `%v`; Expected an error", err)
+	}
+}
+
+func TestCachedProxyHandlerUsesClient(t *testing.T) {
+	server := tlsServer(tls.NoClientCert)
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	handler := CachedProxyHandler(serverURL, mockCacher{data: make(map[string]*CachedResponse)}, DefaultHasher{},
+		ProxyOptions{Client: server.Client()})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Body.String() != "Hello, TLS!" {
+		t.Errorf("Got: `%v`; Expected: `%v`", w.Body.String(), "Hello, TLS!")
+	}
+}
+
+func redirectServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/final" {
+			w.Write([]byte("Final"))
+			return
+		}
+		http.Redirect(w, r, "/final", 302)
+	}))
+}
+
+func TestUpstreamConfigFollowRedirects(t *testing.T) {
+	server := redirectServer()
+	defer server.Close()
+
+	for _, follow := range []bool{false, true} {
+		client, _ := UpstreamConfig{FollowRedirects: follow}.Client()
+		resp, err := client.Get(server.URL + "/start")
+		if err != nil {
+			t.Fatalf("Unexpected error: `%v`", err)
+		}
+		resp.Body.Close()
+
+		expected := 302
+		if follow {
+			expected = 200
+		}
+		if resp.StatusCode != expected {
+			t.Errorf("Got: `%v`; Expected: `%v`", resp.StatusCode, expected)
+		}
+	}
+}
+
+func TestCachedProxyHandlerPassesRedirects(t *testing.T) {
+	server := redirectServer()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	cacher := mockCacher{data: make(map[string]*CachedResponse)}
+	handler := CachedProxyHandler(serverURL, cacher, DefaultHasher{}, ProxyOptions{})
+
+	for _, expected := range []string{cacheMiss, cacheHit} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/start", nil))
+
+		if w.Code != 302 {
+			t.Errorf("Got: `%v`; Expected: `%v`", w.Code, 302)
+		}
+		if location := w.Header().Get("Location"); location != "/final" {
+			t.Errorf("Got: `%v`; Expected: `%v`", location, "/final")
+		}
+		if cache := w.Header().Get("chameleon-cache"); cache != expected {
+			t.Errorf("Got: `%v`; Expected: `%v`", cache, expected)
+		}
+	}
+}
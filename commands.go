@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+)
+
+// A command is a subcommand of chameleon, e.g. `chameleon lint`.
+type command struct {
+	Usage string
+	Run   func(args []string, stdout io.Writer) int
+}
+
+var commands = map[string]command{
+	"compress": {
+		Usage: "Compress (or decompress) the content files in data directories",
+		Run:   compressCommand,
+	},
+	"gc": {
+		Usage: "Remove files no entry refers to from data directories",
+		Run:   gcCommand,
+	},
+	"lint": {
+		Usage: "Check data directories for problems",
+		Run:   lintCommand,
+	},
+	"migrate": {
+		Usage: "Move content files between the flat and sharded layouts",
+		Run:   migrateCommand,
+	},
+	"prune": {
+		Usage: "Remove unused entries from a data directory",
+		Run:   pruneCommand,
+	},
+}
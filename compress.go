@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// gzipCompression is the value of SpecResponse.Compression for content files compressed with gzip.
+const gzipCompression = "gzip"
+
+// compressedName returns the name of a content file once compressed (or decompressed).
+func compressedName(name, compression string) string {
+	name = strings.TrimSuffix(name, ".gz")
+	if compression == gzipCompression {
+		return name + ".gz"
+	}
+	return name
+}
+
+// compressContent compresses body for storage in a content file.
+func compressContent(body []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "":
+		return body, nil
+	case gzipCompression:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(body); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
+
+// decompressContent decompresses the content of a content file.
+func decompressContent(content []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "":
+		return content, nil
+	case gzipCompression:
+		reader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(reader)
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
+
+// Recompress rewrites every content file in the data directory with the given compression ("" for none)
+// and updates spec.json to match. Invalid entries are skipped. It returns the number of content files rewritten.
+func (c *DiskCacher) Recompress(compression string) (int, error) {
+	if _, err := compressContent(nil, compression); err != nil {
+		return 0, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+
+	var rawSpecs []json.RawMessage
+	content := c.readSpecContent()
+	err := json.Unmarshal(content, &rawSpecs)
+	if err != nil {
+		return 0, jsonError(c.specPath, content, 0, err)
+	}
+
+	rewritten := make(map[string]string)
+	for i, raw := range rawSpecs {
+		var spec Spec
+		if json.Unmarshal(raw, &spec) != nil || spec.Compression == compression {
+			continue
+		}
+		// Entries which wouldn't load, such as ones with content outside the data directory, are left alone
+		if validateSpec(&spec) != "" {
+			continue
+		}
+		name := path.Clean(spec.ContentFile)
+		target, ok := rewritten[name]
+		if !ok {
+			target = compressedName(name, compression)
+			body, err := c.readContent(name)
+			if err == nil {
+				body, err = decompressContent(body, spec.Compression)
+			}
+			if err == nil {
+				body, err = compressContent(body, compression)
+			}
+			if err == nil {
+				err = c.writeFile(target, body)
+			}
+			if err != nil {
+				return 0, fmt.Errorf("%v: %v", name, err)
+			}
+			rewritten[name] = target
+		}
+
+		spec.ContentFile = target
+		spec.Compression = compression
+		rawSpecs[i], err = json.Marshal(spec)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(rewritten) == 0 {
+		return 0, nil
+	}
+
+	err = c.writeRawSpecs(rawSpecs)
+	if err != nil {
+		return 0, err
+	}
+	for name, target := range rewritten {
+		if name != target {
+			_ = c.removeContent(name)
+		}
+	}
+	return len(rewritten), nil
+}
+
+func compressCommand(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("compress", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	compression := flags.String("compression", gzipCompression, "Compression for content files: gzip or none")
+	flags.Usage = func() {
+		fmt.Fprintln(stdout, "Usage: chameleon compress [-compression gzip|none] DIR...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *compression == "none" {
+		*compression = ""
+	}
+	if _, err := compressContent(nil, *compression); err != nil || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	status := 0
+	for _, dir := range flags.Args() {
+		rewritten, err := NewDiskCacher(dir).Recompress(*compression)
+		if err != nil {
+			fmt.Fprintf(stdout, "%v: error: %v\n", dir, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "%v: rewrote %d content files\n", dir, rewritten)
+	}
+	return status
+}
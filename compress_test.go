@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompressContent(t *testing.T) {
+	compressed, err := compressContent([]byte("HELLO HELLO HELLO"), gzipCompression)
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	body, err := decompressContent(compressed, gzipCompression)
+	if err != nil || string(body) != "HELLO HELLO HELLO" {
+		t.Errorf("Got: `%v`, `%v`; Expected: `HELLO HELLO HELLO`", string(body), err)
+	}
+
+	if _, err := compressContent(nil, "zstd"); err == nil {
+		t.Errorf("Expected an error for an unknown compression")
+	}
+}
+
+func TestCompressedName(t *testing.T) {
+	if name := compressedName("abc", gzipCompression); name != "abc.gz" {
+		t.Errorf("Got: `%v`; Expected: `abc.gz`", name)
+	}
+	if name := compressedName("abc.gz", ""); name != "abc" {
+		t.Errorf("Got: `%v`; Expected: `abc`", name)
+	}
+}
+
+func TestDiskCacherPutCompressed(t *testing.T) {
+	fs := mapFileSystem{}
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+	cacher.Compression = gzipCompression
+
+	recorder := httptest.NewRecorder()
+	recorder.Code = 200
+	_, _ = recorder.WriteString("BODY")
+	response := cacher.Put("key", recorder)
+	if string(response.Body) != "BODY" {
+		t.Errorf("Got: `%v`; Expected: `BODY`", string(response.Body))
+	}
+
+	name := contentName([]byte("BODY")) + ".gz"
+	if content, ok := fs["data/"+name]; !ok || bytes.Equal(content, []byte("BODY")) {
+		t.Errorf("Content file `%v` was not compressed", name)
+	}
+
+	// Load it back from disk
+	cacher = NewDiskCacher("data")
+	cacher.FileSystem = fs
+	err := cacher.SeedCache()
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if response := cacher.Get("key"); response == nil || string(response.Body) != "BODY" {
+		t.Errorf("Got: `%v`; Expected: `BODY`", response)
+	}
+}
+
+func TestDiskCacherRecompress(t *testing.T) {
+	fs := mapFileSystem{
+		"data/spec.json": []byte(`[
+    {"key": "a", "response": {"status_code": 200, "content": "ab/cd/abcdef"}},
+    {"key": "b", "response": {"status_code": 200, "content": "abcdef"}}
+]`),
+		"data/ab/cd/abcdef": []byte("CONTENT"),
+	}
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+
+	rewritten, err := cacher.Recompress(gzipCompression)
+	if err != nil || rewritten != 2 {
+		t.Fatalf("Got: `%v`, `%v`; Expected: `2` files rewritten", rewritten, err)
+	}
+	if _, ok := fs["data/ab/cd/abcdef"]; ok {
+		t.Errorf("Uncompressed content file was not removed")
+	}
+	if _, ok := fs["data/ab/cd/abcdef.gz"]; !ok {
+		t.Errorf("Compressed content file was not written in the same layout")
+	}
+	if err := cacher.SeedCache(); err != nil || string(cacher.Get("b").Body) != "CONTENT" {
+		t.Errorf("Got: `%v`; Expected compressed entries to load", err)
+	}
+
+	rewritten, err = cacher.Recompress("")
+	if err != nil || rewritten != 2 {
+		t.Fatalf("Got: `%v`, `%v`; Expected: `2` files rewritten", rewritten, err)
+	}
+	if string(fs["data/ab/cd/abcdef"]) != "CONTENT" {
+		t.Errorf("Content file was not decompressed")
+	}
+}
+
+func TestCompressCommand(t *testing.T) {
+	var out bytes.Buffer
+	status := compressCommand([]string{"-compression", "zstd", "./data"}, &out)
+	if status != 2 {
+		t.Errorf("Got: `%v`; Expected: `2`", status)
+	}
+}
+
+func TestDiskCacherRecompressSkipsContentOutsideDataDir(t *testing.T) {
+	spec := `[{"key": "a", "response": {"status_code": 200, "content": "../secret.txt"}}]`
+	fs := mapFileSystem{
+		"data/spec.json": []byte(spec),
+		"secret.txt":     []byte("SECRET"),
+	}
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+
+	rewritten, err := cacher.Recompress(gzipCompression)
+	if err != nil || rewritten != 0 {
+		t.Errorf("Got: `%v`, `%v`; Expected: `0` files rewritten", rewritten, err)
+	}
+	if _, ok := fs["secret.txt.gz"]; ok {
+		t.Errorf("Content file outside the data directory was compressed")
+	}
+	if string(fs["secret.txt"]) != "SECRET" || string(fs["data/spec.json"]) != spec {
+		t.Errorf("Files were changed for an entry outside the data directory")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// splitSetCookie splits Set-Cookie headers which were joined with commas when they were recorded.
+// A comma only separates cookies when it is followed by NAME=, which tells it apart from the comma
+// in an Expires date.
+func splitSetCookie(value string) []string {
+	var cookies []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] != ',' {
+			continue
+		}
+		next := strings.TrimLeft(value[i+1:], " ")
+		end := strings.IndexAny(next, ";,")
+		if end < 0 {
+			end = len(next)
+		}
+		if eq := strings.Index(next[:end], "="); eq > 0 && !strings.ContainsAny(next[:eq], " \t") {
+			cookies = append(cookies, strings.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(cookies, strings.TrimSpace(value[start:]))
+}
+
+// cookieRewriter rewrites the cookies set by the proxied service so browsers keep them for chameleon's address.
+type cookieRewriter struct {
+	// secure is set when clients reach chameleon over HTTPS
+	secure bool
+}
+
+// newCookieRewriter returns a cookieRewriter for a request, or nil if cookies shouldn't be rewritten.
+func newCookieRewriter(r *http.Request, options ProxyOptions) *cookieRewriter {
+	if !options.RewriteCookies {
+		return nil
+	}
+	secure := r.TLS != nil
+	if options.PublicURL != nil {
+		secure = options.PublicURL.Scheme == "https"
+	}
+	return &cookieRewriter{secure: secure}
+}
+
+// rewrite removes the Domain attribute of a Set-Cookie header, so the cookie belongs to chameleon's host.
+// Unless clients use HTTPS, Secure is removed too, and SameSite=None (which requires Secure) becomes Lax.
+func (c *cookieRewriter) rewrite(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		attribute := strings.TrimSpace(part)
+		name := strings.ToLower(attribute)
+		if i := strings.Index(name, "="); i >= 0 {
+			name = strings.TrimSpace(name[:i])
+		}
+
+		switch {
+		case name == "domain":
+			continue
+		case name == "secure" && !c.secure:
+			continue
+		case name == "samesite" && !c.secure && strings.EqualFold(strings.TrimSpace(attribute[strings.Index(attribute, "=")+1:]), "none"):
+			attribute = "SameSite=Lax"
+		}
+		kept = append(kept, " "+attribute)
+	}
+	return strings.Join(kept, ";")
+}
+
+// rewriteHeaders rewrites every Set-Cookie header.
+func (c *cookieRewriter) rewriteHeaders(header http.Header) {
+	for i, cookie := range header["Set-Cookie"] {
+		header["Set-Cookie"][i] = c.rewrite(cookie)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSplitSetCookie(t *testing.T) {
+	tests := map[string][]string{
+		"a=1":                      {"a=1"},
+		"a=1; Path=/, b=2; Secure": {"a=1; Path=/", "b=2; Secure"},
+		"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT, b=2": {"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"},
+		"a=x,y": {"a=x,y"},
+	}
+	for value, expected := range tests {
+		if actual := splitSetCookie(value); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Got: `%q`; Expected: `%q`", actual, expected)
+		}
+	}
+}
+
+func TestCookieRewriter(t *testing.T) {
+	cookie := "session=abc; Domain=.example.com; Path=/; Secure; HttpOnly; SameSite=None"
+
+	insecure := &cookieRewriter{}
+	if actual := insecure.rewrite(cookie); actual != "session=abc; Path=/; HttpOnly; SameSite=Lax" {
+		t.Errorf("Got: `%v`; Expected Domain and Secure to be removed", actual)
+	}
+	secure := &cookieRewriter{secure: true}
+	if actual := secure.rewrite(cookie); actual != "session=abc; Path=/; Secure; HttpOnly; SameSite=None" {
+		t.Errorf("Got: `%v`; Expected only Domain to be removed", actual)
+	}
+	if actual := insecure.rewrite("a=1; SameSite=Strict"); actual != "a=1; SameSite=Strict" {
+		t.Errorf("Got: `%v`; Expected: `a=1; SameSite=Strict`", actual)
+	}
+}
+
+func TestNewCookieRewriter(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	if newCookieRewriter(req, ProxyOptions{}) != nil {
+		t.Errorf("Expected no rewriter unless RewriteCookies is set")
+	}
+	if newCookieRewriter(req, ProxyOptions{RewriteCookies: true}).secure {
+		t.Errorf("Expected plain HTTP requests not to be secure")
+	}
+	req.TLS = &tls.ConnectionState{}
+	if !newCookieRewriter(req, ProxyOptions{RewriteCookies: true}).secure {
+		t.Errorf("Expected HTTPS requests to be secure")
+	}
+	public, _ := url.Parse("http://localhost:6005")
+	if newCookieRewriter(req, ProxyOptions{RewriteCookies: true, PublicURL: public}).secure {
+		t.Errorf("Expected the public URL to decide whether cookies are secure")
+	}
+}
+
+func TestCachedProxyHandlerRewritesCookies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Domain=api.example.com; Secure; SameSite=None")
+		w.Header().Add("Set-Cookie", "theme=dark; Expires=Wed, 21 Oct 2037 07:28:00 GMT; Domain=api.example.com")
+	}))
+	defer upstream.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := mockCacher{data: make(map[string]*CachedResponse)}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{RewriteCookies: true})
+
+	expected := []string{"session=abc; SameSite=Lax", "theme=dark; Expires=Wed, 21 Oct 2037 07:28:00 GMT"}
+	for _, status := range []string{cacheMiss, cacheHit} {
+		req, _ := http.NewRequest("GET", "/login", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if actual := w.Header()["Set-Cookie"]; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Got: `%q`; Expected: `%q` when %v", actual, expected, status)
+		}
+	}
+}
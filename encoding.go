@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Content-Encodings which are stored decoded and re-encoded on replay
+const (
+	gzipEncoding    = "gzip"
+	deflateEncoding = "deflate"
+)
+
+// decodableEncoding returns the normalized name of a Content-Encoding header value if chameleon can decode it,
+// or "" if it can't (including when several encodings were applied).
+func decodableEncoding(value string) string {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "gzip", "x-gzip":
+		return gzipEncoding
+	case "deflate":
+		return deflateEncoding
+	}
+	return ""
+}
+
+// decodeContent returns a reader which decodes body according to encoding.
+func decodeContent(body io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case gzipEncoding:
+		return gzip.NewReader(body)
+	case deflateEncoding:
+		// "deflate" should be zlib wrapped, but some servers send raw deflate data
+		buffered := bufio.NewReader(body)
+		header, err := buffered.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (int(header[0])<<8|int(header[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	}
+	return body, nil
+}
+
+// negotiateEncoding picks the Content-Encoding to replay a response originally encoded with original,
+// according to a request's Accept-Encoding header. It returns "" to send the body unencoded.
+func negotiateEncoding(acceptEncoding, original string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	qualities := make(map[string]float64)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		qualities[name] = quality
+	}
+	accepted := func(encoding string) float64 {
+		if q, ok := qualities[encoding]; ok {
+			return q
+		}
+		return qualities["*"]
+	}
+
+	if accepted(original) > 0 {
+		return original
+	}
+	best, bestQuality := "", 0.0
+	for _, encoding := range []string{gzipEncoding, deflateEncoding} {
+		if q := accepted(encoding); q > bestQuality {
+			best, bestQuality = encoding, q
+		}
+	}
+	return best
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encodingWriter encodes everything written to it before passing it on to the client.
+type encodingWriter struct {
+	http.ResponseWriter
+	encoder compressor
+}
+
+func newEncodingWriter(w http.ResponseWriter, encoding string) *encodingWriter {
+	var encoder compressor
+	if encoding == deflateEncoding {
+		encoder = zlib.NewWriter(w)
+	} else {
+		encoder = gzip.NewWriter(w)
+	}
+	return &encodingWriter{ResponseWriter: w, encoder: encoder}
+}
+
+func (ew *encodingWriter) Write(p []byte) (int, error) {
+	return ew.encoder.Write(p)
+}
+
+func (ew *encodingWriter) Flush() {
+	// If this fails, there isn't much to do
+	_ = ew.encoder.Flush()
+	if flusher, ok := ew.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes any remaining encoded data to the client.
+func (ew *encodingWriter) Close() error {
+	return ew.encoder.Close()
+}
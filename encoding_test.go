@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDecodableEncoding(t *testing.T) {
+	for value, expected := range map[string]string{
+		"gzip":          gzipEncoding,
+		"X-Gzip":        gzipEncoding,
+		"deflate":       deflateEncoding,
+		"br":            "",
+		"gzip, deflate": "",
+		"":              "",
+	} {
+		if actual := decodableEncoding(value); actual != expected {
+			t.Errorf("Got: `%v`; Expected: `%v` for `%v`", actual, expected, value)
+		}
+	}
+}
+
+func TestDecodeContent(t *testing.T) {
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"zlib": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"raw flate": func(w io.Writer) io.WriteCloser {
+			writer, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return writer
+		},
+	}
+	for name, encoder := range encoders {
+		var buf bytes.Buffer
+		writer := encoder(&buf)
+		_, _ = writer.Write([]byte("decoded"))
+		_ = writer.Close()
+
+		encoding := deflateEncoding
+		if name == "gzip" {
+			encoding = gzipEncoding
+		}
+		reader, err := decodeContent(&buf, encoding)
+		if err != nil {
+			t.Fatalf("Unexpected error: `%v`", err)
+		}
+		decoded, err := ioutil.ReadAll(reader)
+		if err != nil || string(decoded) != "decoded" {
+			t.Errorf("Got: `%v`, `%v`; Expected: `decoded` for %v", string(decoded), err, name)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		original       string
+		expected       string
+	}{
+		{"", gzipEncoding, ""},
+		{"gzip, deflate, br", gzipEncoding, gzipEncoding},
+		{"gzip, deflate, br", deflateEncoding, deflateEncoding},
+		{"deflate", gzipEncoding, deflateEncoding},
+		{"br", gzipEncoding, ""},
+		{"gzip;q=0, deflate;q=0.5", gzipEncoding, deflateEncoding},
+		{"*", deflateEncoding, deflateEncoding},
+		{"*;q=0", gzipEncoding, ""},
+		{"identity", gzipEncoding, ""},
+	}
+	for _, test := range tests {
+		if actual := negotiateEncoding(test.acceptEncoding, test.original); actual != test.expected {
+			t.Errorf("Got: `%v`; Expected: `%v` for `%v`", actual, test.expected, test.acceptEncoding)
+		}
+	}
+}
+
+func TestCachedProxyHandlerDecodesResponses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := gzip.NewWriter(w)
+		_, _ = writer.Write([]byte("compressed upstream"))
+		_ = writer.Close()
+	}))
+	defer upstream.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := mockCacher{data: make(map[string]*CachedResponse)}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{})
+
+	request := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/compressed", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Recording passes the encoded body on as-is
+	w := request("gzip")
+	hash := w.Header().Get("chameleon-request-hash")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Got: `%v`; Expected: `gzip`", w.Header().Get("Content-Encoding"))
+	}
+	response := cache.data[hash]
+	if response == nil || string(response.Body) != "compressed upstream" || response.Encoding != gzipEncoding {
+		t.Fatalf("Got: `%+v`; Expected the body to be recorded decoded", response)
+	}
+	if response.Headers["Content-Encoding"] != "" {
+		t.Errorf("Got: `%v`; Expected no recorded Content-Encoding", response.Headers["Content-Encoding"])
+	}
+
+	w = request("")
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "compressed upstream" {
+		t.Errorf("Got: `%v` `%v`; Expected the body unencoded", w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Got: `%v`; Expected: `Accept-Encoding`", w.Header().Get("Vary"))
+	}
+
+	for encoding, newReader := range map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	} {
+		w = request(encoding)
+		if w.Header().Get("Content-Encoding") != encoding {
+			t.Errorf("Got: `%v`; Expected: `%v`", w.Header().Get("Content-Encoding"), encoding)
+		}
+		reader, err := newReader(w.Body)
+		if err != nil {
+			t.Fatalf("Unexpected error: `%v`", err)
+		}
+		body, _ := ioutil.ReadAll(reader)
+		if string(body) != "compressed upstream" {
+			t.Errorf("Got: `%v`; Expected: `compressed upstream` for %v", string(body), encoding)
+		}
+	}
+}
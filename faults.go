@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault describes a failure to inject into responses for requests whose path starts with Prefix.
+type Fault struct {
+	Prefix string `json:"prefix"`
+	// Probability is the chance, from 0 to 1, that a request is affected; zero means every request
+	Probability float64 `json:"probability,omitempty"`
+	// Status responds with this status code instead of the real response
+	Status int `json:"status,omitempty"`
+	// Reset closes the connection without responding
+	Reset bool `json:"reset,omitempty"`
+	// Truncate closes the connection after this many bytes of the body have been sent
+	Truncate int64 `json:"truncate,omitempty"`
+	// Drip sends the body at this many bytes per second
+	Drip int64 `json:"drip,omitempty"`
+	// Latency is the number of milliseconds to wait before responding
+	Latency int64 `json:"latency_ms,omitempty"`
+}
+
+func (f Fault) validate() error {
+	switch {
+	case !strings.HasPrefix(f.Prefix, "/"):
+		return fmt.Errorf("prefix %q must start with /", f.Prefix)
+	case f.Probability < 0 || f.Probability > 1:
+		return fmt.Errorf("%v: probability must be between 0 and 1", f.Prefix)
+	case f.Status != 0 && (f.Status < 100 || f.Status > 999):
+		return fmt.Errorf("%v: invalid status code %d", f.Prefix, f.Status)
+	case f.Truncate < 0 || f.Drip < 0 || f.Latency < 0:
+		return fmt.Errorf("%v: truncate, drip and latency must not be negative", f.Prefix)
+	case f.Status == 0 && !f.Reset && f.Truncate == 0 && f.Drip == 0 && f.Latency == 0:
+		return fmt.Errorf("%v: no fault given", f.Prefix)
+	}
+	return nil
+}
+
+// ParseFault parses a fault for requests under prefix from a comma separated list of
+// status:CODE, reset, truncate:BYTES, drip:BYTES_PER_SECOND, latency:DURATION and probability:P
+// (e.g. status:503,probability:0.3).
+func ParseFault(prefix, s string) (Fault, error) {
+	fault := Fault{Prefix: prefix}
+	for _, item := range strings.Split(s, ",") {
+		name, arg := item, ""
+		if i := strings.Index(item, ":"); i >= 0 {
+			name, arg = item[:i], item[i+1:]
+		}
+
+		var err error
+		switch name {
+		case "status":
+			fault.Status, err = strconv.Atoi(arg)
+		case "reset":
+			fault.Reset = true
+		case "truncate":
+			fault.Truncate, err = strconv.ParseInt(arg, 10, 64)
+		case "drip":
+			fault.Drip, err = strconv.ParseInt(arg, 10, 64)
+		case "latency":
+			var latency time.Duration
+			latency, err = time.ParseDuration(arg)
+			fault.Latency = int64(latency / time.Millisecond)
+		case "probability":
+			fault.Probability, err = strconv.ParseFloat(arg, 64)
+		default:
+			err = fmt.Errorf("unknown fault %q", name)
+		}
+		if err != nil {
+			return Fault{}, fmt.Errorf("invalid fault %q: %v", s, err)
+		}
+	}
+	return fault, fault.validate()
+}
+
+// FaultInjector injects faults into responses. Its faults may be changed while it is in use.
+type FaultInjector struct {
+	faults []Fault
+	mutex  sync.RWMutex
+}
+
+// NewFaultInjector returns a FaultInjector with no faults.
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{faults: []Fault{}}
+}
+
+// Faults returns the faults being injected.
+func (f *FaultInjector) Faults() []Fault {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return append([]Fault{}, f.faults...)
+}
+
+// SetFaults replaces the faults being injected. Nothing changes if any of them are invalid.
+func (f *FaultInjector) SetFaults(faults []Fault) error {
+	for _, fault := range faults {
+		if err := fault.validate(); err != nil {
+			return err
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.faults = append([]Fault{}, faults...)
+	return nil
+}
+
+// match returns the fault for the route with the longest prefix matching path, if any.
+func (f *FaultInjector) match(path string) (Fault, bool) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	prefixes := make([]string, len(f.faults))
+	for i, fault := range f.faults {
+		prefixes[i] = fault.Prefix
+	}
+	i := longestPrefix(path, prefixes)
+	if i < 0 {
+		return Fault{}, false
+	}
+	return f.faults[i], true
+}
+
+// inject applies any fault matching r. It returns the writer to send the response to,
+// or nil if the fault has already taken care of the response.
+func (f *FaultInjector) inject(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if f == nil {
+		return w
+	}
+	fault, ok := f.match(r.URL.Path)
+	if !ok || (fault.Probability > 0 && rand.Float64() >= fault.Probability) {
+		return w
+	}
+
+	time.Sleep(time.Duration(fault.Latency) * time.Millisecond)
+	switch {
+	case fault.Reset:
+		resetConnection(w)
+		return nil
+	case fault.Status != 0:
+		w.Header().Set("chameleon-fault", fault.Prefix)
+		w.WriteHeader(fault.Status)
+		fmt.Fprintf(w, "Fault injected by chameleon for %v", fault.Prefix)
+		return nil
+	case fault.Truncate > 0 || fault.Drip > 0:
+		remaining := int64(-1)
+		if fault.Truncate > 0 {
+			remaining = fault.Truncate
+		}
+		return &faultWriter{ResponseWriter: w, remaining: remaining, drip: fault.Drip}
+	}
+	return w
+}
+
+// resetConnection closes the client connection without sending a response.
+func resetConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		// Send a RST rather than closing cleanly
+		_ = tcp.SetLinger(0)
+	}
+	// If this fails, there isn't much to do
+	_ = conn.Close()
+}
+
+// faultWriter sends a response body slowly, or cuts it short.
+type faultWriter struct {
+	http.ResponseWriter
+	// remaining is the number of bytes to send before closing the connection, or -1 to send everything
+	remaining int64
+	// drip is the number of bytes to send per second, or zero to send everything at once
+	drip int64
+}
+
+func (fw *faultWriter) Write(p []byte) (int, error) {
+	truncated := false
+	if fw.remaining >= 0 && int64(len(p)) > fw.remaining {
+		p = p[:fw.remaining]
+		truncated = true
+	}
+
+	n, err := fw.write(p)
+	if fw.remaining >= 0 {
+		fw.remaining -= int64(n)
+	}
+	if truncated {
+		fw.Flush()
+		// Abort the response, so the client sees the connection close part way through the body
+		panic(http.ErrAbortHandler)
+	}
+	return n, err
+}
+
+func (fw *faultWriter) write(p []byte) (int, error) {
+	if fw.drip == 0 {
+		return fw.ResponseWriter.Write(p)
+	}
+
+	// Send a tenth of a second's worth of bytes at a time
+	chunk := int(fw.drip / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	written := 0
+	for written < len(p) {
+		end := written + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		n, err := fw.ResponseWriter.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		fw.Flush()
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(fw.drip))
+	}
+	return written, nil
+}
+
+func (fw *faultWriter) Flush() {
+	if flusher, ok := fw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (fw *faultWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := fw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// parseFaultRoutes parses the fault for each route given with -route-fault.
+func parseFaultRoutes(routes routeFlag) ([]Fault, error) {
+	faults := make([]Fault, len(routes))
+	for i, route := range routes {
+		fault, err := ParseFault(route.Prefix, route.Value)
+		if err != nil {
+			return nil, err
+		}
+		faults[i] = fault
+	}
+	return faults, nil
+}
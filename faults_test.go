@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFault(t *testing.T) {
+	fault, err := ParseFault("/orders", "status:503,probability:0.3,latency:1.5s")
+	if err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+	expected := Fault{Prefix: "/orders", Status: 503, Probability: 0.3, Latency: 1500}
+	if fault != expected {
+		t.Errorf("Got: `%+v`; Expected: `%+v`", fault, expected)
+	}
+
+	fault, err = ParseFault("/", "reset")
+	if err != nil || !fault.Reset {
+		t.Errorf("Got: `%+v`, `%v`; Expected a reset fault", fault, err)
+	}
+
+	for _, s := range []string{"", "probability:0.5", "status:abc", "status:42", "explode", "probability:2,reset", "drip:-1"} {
+		if _, err := ParseFault("/", s); err == nil {
+			t.Errorf("Expected an error for `%v`", s)
+		}
+	}
+	if _, err := ParseFault("orders", "reset"); err == nil {
+		t.Errorf("Expected an error for a prefix without a leading slash")
+	}
+}
+
+func TestFaultInjectorSetFaults(t *testing.T) {
+	injector := NewFaultInjector()
+	valid := Fault{Prefix: "/", Status: 500}
+	if err := injector.SetFaults([]Fault{valid}); err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+	if err := injector.SetFaults([]Fault{{Prefix: "/orders", Status: 503}, {Prefix: "/"}}); err == nil {
+		t.Errorf("Expected an error for a fault without any effect")
+	}
+	if faults := injector.Faults(); len(faults) != 1 || faults[0] != valid {
+		t.Errorf("Got: `%v`; Expected the faults to be unchanged", faults)
+	}
+}
+
+// faultServer serves a cached "0123456789" at every path, with faults from injector.
+func faultServer(injector *FaultInjector) *httptest.Server {
+	serverURL, _ := url.Parse("http://example.com")
+	cache := mockCacher{data: map[string]*CachedResponse{
+		"cached": {StatusCode: 200, Body: []byte("0123456789")},
+	}}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{Faults: injector})
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("chameleon-request-hash", "cached")
+		handler(w, r)
+	}))
+}
+
+func TestCachedProxyHandlerInjectsFaults(t *testing.T) {
+	injector := NewFaultInjector()
+	_ = injector.SetFaults([]Fault{
+		{Prefix: "/status", Status: 503},
+		{Prefix: "/reset", Reset: true},
+		{Prefix: "/truncate", Truncate: 4},
+		{Prefix: "/drip", Drip: 50},
+		{Prefix: "/never", Status: 503, Probability: 0.000001},
+	})
+	server := faultServer(injector)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/status/5")
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 || resp.Header.Get("chameleon-fault") != "/status" {
+		t.Errorf("Got: `%v`; Expected: `503`", resp.StatusCode)
+	}
+
+	if _, err = http.Get(server.URL + "/reset"); err == nil {
+		t.Errorf("Expected the connection to be reset")
+	}
+
+	resp, err = http.Get(server.URL + "/truncate")
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil || string(body) != "0123" {
+		t.Errorf("Got: `%v`, `%v`; Expected `0123` and an error", string(body), err)
+	}
+
+	start := time.Now()
+	resp, err = http.Get(server.URL + "/drip")
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if elapsed := time.Since(start); string(body) != "0123456789" || elapsed < 150*time.Millisecond {
+		t.Errorf("Got: `%v` after `%v`; Expected the full body after about 200ms", string(body), elapsed)
+	}
+
+	resp, err = http.Get(server.URL + "/never")
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("Got: `%v`; Expected: `200`", resp.StatusCode)
+	}
+}
+
+func TestFaultsHandler(t *testing.T) {
+	injector := NewFaultInjector()
+	handler := FaultsHandler(injector)
+
+	req, _ := http.NewRequest("PUT", "/_faults", strings.NewReader(`[{"prefix": "/orders", "status": 503, "probability": 0.5}]`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("Got: `%v`; Expected: `200`", w.Code)
+	}
+	expected := Fault{Prefix: "/orders", Status: 503, Probability: 0.5}
+	if faults := injector.Faults(); len(faults) != 1 || faults[0] != expected {
+		t.Errorf("Got: `%v`; Expected: `%v`", faults, expected)
+	}
+
+	req, _ = http.NewRequest("GET", "/_faults", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var listed []Fault
+	_ = json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0] != expected {
+		t.Errorf("Got: `%v`; Expected: `%v`", w.Body.String(), expected)
+	}
+
+	for _, body := range []string{`{"prefix": "/"}`, `[{"prefix": "/"}]`} {
+		req, _ = http.NewRequest("PUT", "/_faults", strings.NewReader(body))
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Errorf("Got: `%v`; Expected: `400` for `%v`", w.Code, body)
+		}
+	}
+
+	req, _ = http.NewRequest("DELETE", "/_faults", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != "[]" || len(injector.Faults()) != 0 {
+		t.Errorf("Got: `%v` `%v`; Expected all faults to be removed", w.Code, w.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/_faults", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 405 {
+		t.Errorf("Got: `%v`; Expected: `405`", w.Code)
+	}
+}
+
+func TestCachedProxyHandlerDoesNotRecordFaults(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+	defer upstream.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := mockCacher{data: make(map[string]*CachedResponse)}
+	injector := NewFaultInjector()
+	_ = injector.SetFaults([]Fault{{Prefix: "/", Drip: 1000}})
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{Faults: injector})
+
+	req, _ := http.NewRequest("GET", "/drip", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Body.String() != "0123456789" {
+		t.Errorf("Got: `%v`; Expected: `0123456789`", w.Body.String())
+	}
+	if len(cache.data) != 0 {
+		t.Errorf("Got: `%v`; Expected the faulty response not to be recorded", cache.data)
+	}
+
+	_ = injector.SetFaults(nil)
+	req, _ = http.NewRequest("GET", "/drip", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if len(cache.data) != 1 {
+		t.Errorf("Got: `%v` entries; Expected the response to be recorded once the fault is removed", len(cache.data))
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ForwardProxy serves requests sent to chameleon as an HTTP proxy (e.g. by clients honoring HTTP_PROXY), whose
+// request URI is absolute. Each request is proxied to the host it names and recorded in a directory for that
+// host under the data directory. Other requests are passed on to next.
+//
+// HTTPS requests, tunnelled with CONNECT, are intercepted using certificates issued by ca.
+type ForwardProxy struct {
+	dataDir string
+	ca      *CertificateAuthority
+	// newCacher returns the cacher for a host's data directory, which has already been created
+	newCacher func(dir string) (*DiskCacher, error)
+	hasher    Hasher
+	options   ProxyOptions
+	next      http.Handler
+	cachers   map[string]*DiskCacher
+	handlers  map[string]http.Handler
+	mutex     sync.Mutex
+}
+
+// NewForwardProxy returns a ForwardProxy recording under dataDir. If ca is nil, CONNECT requests are refused.
+func NewForwardProxy(dataDir string, ca *CertificateAuthority, newCacher func(dir string) (*DiskCacher, error), hasher Hasher, options ProxyOptions, next http.Handler) *ForwardProxy {
+	return &ForwardProxy{
+		dataDir:   dataDir,
+		ca:        ca,
+		newCacher: newCacher,
+		hasher:    hasher,
+		options:   options,
+		next:      next,
+		cachers:   make(map[string]*DiskCacher),
+		handlers:  make(map[string]http.Handler),
+	}
+}
+
+// hostDir returns the name of the directory for the recordings of host (e.g. example.com_8080),
+// or an error if host can't be used as a directory name.
+func hostDir(host string) (string, error) {
+	name := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(strings.ToLower(host))
+	if name == "" || name[0] == '.' {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+	for i := 0; i < len(name); i++ {
+		if !isHostByte(name[i]) && name[i] != '_' {
+			return "", fmt.Errorf("invalid host %q", host)
+		}
+	}
+	return name, nil
+}
+
+// handler returns the handler proxying to serverURL, creating it (and its cacher) on first use.
+func (f *ForwardProxy) handler(serverURL *url.URL) (http.Handler, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := serverURL.String()
+	if handler, ok := f.handlers[key]; ok {
+		return handler, nil
+	}
+
+	name, err := hostDir(serverURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	// http and https requests for the same host share their recordings
+	cacher, ok := f.cachers[name]
+	if !ok {
+		dir := filepath.Join(f.dataDir, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if cacher, err = f.newCacher(dir); err != nil {
+			return nil, err
+		}
+		f.cachers[name] = cacher
+		log.Printf("Recording '%v' in %v\n", serverURL.Host, dir)
+	}
+	handler := CachedProxyHandler(serverURL, cacher, f.hasher, f.options)
+	f.handlers[key] = handler
+	return handler, nil
+}
+
+func (f *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "CONNECT" {
+		f.intercept(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		f.next.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		http.Error(w, fmt.Sprintf("Unsupported scheme %q", r.URL.Scheme), http.StatusBadRequest)
+		return
+	}
+
+	handler, err := f.handler(&url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// Cachers returns the cachers for the hosts requested so far.
+func (f *ForwardProxy) Cachers() []*DiskCacher {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	cachers := make([]*DiskCacher, 0, len(f.cachers))
+	for _, cacher := range f.cachers {
+		cachers = append(cachers, cacher)
+	}
+	return cachers
+}
+
+// Reload reloads the recordings of every host requested so far, returning the first error.
+func (f *ForwardProxy) Reload() error {
+	reloaders := Reloaders{}
+	for _, cacher := range f.Cachers() {
+		reloaders = append(reloaders, cacher)
+	}
+	return reloaders.Reload()
+}
+
+// intercept answers a CONNECT request, then terminates TLS on the tunnel with a certificate for the requested host,
+// serving the decrypted requests as if they had been sent to the proxy as https:// URLs.
+func (f *ForwardProxy) intercept(w http.ResponseWriter, r *http.Request) {
+	if f.ca == nil {
+		http.Error(w, "HTTPS interception is not enabled", http.StatusMethodNotAllowed)
+		return
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "443"
+	}
+	target := net.JoinHostPort(host, port)
+	if port == "443" {
+		// Match the Host clients send, so https:// URLs share the recordings of http:// ones
+		target = host
+	}
+	if _, err := hostDir(target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection can't be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		// If this fails, there isn't much to do
+		_ = conn.Close()
+		return
+	}
+	log.Printf("-> Intercepting HTTPS for %v\n", target)
+
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return f.ca.Certificate(hello.ServerName)
+			}
+			return f.ca.Certificate(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+	listener := &connListener{closed: make(chan struct{})}
+	listener.conn = tls.Server(&listenedConn{Conn: &bufferedConn{Conn: conn, reader: buffered.Reader}, listener: listener}, config)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Scheme = "https"
+		r.URL.Host = target
+		f.ServeHTTP(w, r)
+	})}
+	// Returns once the client closes the tunnel
+	_ = server.Serve(listener)
+}
+
+// bufferedConn reads anything already read from the connection after CONNECT, then the connection itself.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// connListener is a net.Listener accepting a single connection, so an http.Server can serve it.
+type connListener struct {
+	conn   net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Accept returns the connection, then blocks until it is closed.
+func (l *connListener) Accept() (net.Conn, error) {
+	if conn := l.conn; conn != nil {
+		l.conn = nil
+		return conn, nil
+	}
+	<-l.closed
+	return nil, io.EOF
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return dummyAddr{}
+}
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "tcp" }
+func (dummyAddr) String() string  { return "chameleon-tunnel" }
+
+// listenedConn closes its listener along with itself, so the http.Server serving it returns.
+type listenedConn struct {
+	net.Conn
+	listener *connListener
+}
+
+func (c *listenedConn) Close() error {
+	err := c.Conn.Close()
+	// If this fails, there isn't much to do
+	_ = c.listener.Close()
+	return err
+}
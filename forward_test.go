@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHostDir(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"example.com", "example.com"},
+		{"API.Example.com:8080", "api.example.com_8080"},
+		{"[::1]:8080", "__1_8080"},
+	}
+
+	for _, test := range tests {
+		if name, err := hostDir(test.host); err != nil || name != test.expected {
+			t.Errorf("Got: `%v` (%v); Expected: `%v`", name, err, test.expected)
+		}
+	}
+}
+
+func TestHostDirInvalid(t *testing.T) {
+	for _, host := range []string{"", "..", ".example.com", "example.com/..", `example\com`} {
+		if name, err := hostDir(host); err == nil {
+			t.Errorf("Got: `%v`; Expected an error for `%v`", name, host)
+		}
+	}
+}
+
+func TestForwardProxyRecordsPerHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from " + r.URL.Path))
+	}))
+	defer upstream.Close()
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+	forward := NewForwardProxy(dir, nil, func(dir string) (*DiskCacher, error) {
+		cacher := NewDiskCacher(dir)
+		return cacher, cacher.SeedCache()
+	}, DefaultHasher{}, ProxyOptions{}, next)
+
+	for _, expected := range []string{cacheMiss, cacheHit} {
+		w := httptest.NewRecorder()
+		forward.ServeHTTP(w, httptest.NewRequest("GET", upstream.URL+"/hello", nil))
+
+		if w.Body.String() != "Hello from /hello" {
+			t.Errorf("Got: `%v`; Expected: `%v`", w.Body.String(), "Hello from /hello")
+		}
+		if cache := w.Header().Get("chameleon-cache"); cache != expected {
+			t.Errorf("Got: `%v`; Expected: `%v`", cache, expected)
+		}
+	}
+
+	name, _ := hostDir(strings.TrimPrefix(upstream.URL, "http://"))
+	if _, err := os.Stat(filepath.Join(dir, name, "spec.json")); err != nil {
+		t.Errorf("Got: `%v`; Expected the recording in `%v`", err, name)
+	}
+	if cachers := forward.Cachers(); len(cachers) != 1 {
+		t.Errorf("Got: `%v`; Expected: `%v`", len(cachers), 1)
+	}
+	if err := forward.Reload(); err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+}
+
+func TestForwardProxyPassesOnOtherRequests(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+	forward := NewForwardProxy("", nil, nil, DefaultHasher{}, ProxyOptions{}, next)
+
+	w := httptest.NewRecorder()
+	forward.ServeHTTP(w, httptest.NewRequest("POST", "/_reload", nil))
+	if w.Code != 204 {
+		t.Errorf("Got: `%v`; Expected: `%v`", w.Code, 204)
+	}
+
+	w = httptest.NewRecorder()
+	forward.ServeHTTP(w, httptest.NewRequest("GET", "ftp://example.com/file", nil))
+	if w.Code != 400 {
+		t.Errorf("Got: `%v`; Expected: `%v`", w.Code, 400)
+	}
+}
+
+func TestForwardProxyInterceptsHTTPS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	ca, _ := LoadOrCreateCA(dir)
+
+	var created string
+	forward := NewForwardProxy(dir, ca, func(dir string) (*DiskCacher, error) {
+		created = filepath.Base(dir)
+		cacher := NewDiskCacher(dir)
+		seeded := httptest.NewRecorder()
+		seeded.Header().Set("_chameleon-seeded-skip-disk", "true")
+		seeded.WriteString("Hello, HTTPS!")
+		cacher.Put("abcdef12345", seeded)
+		return cacher, nil
+	}, DefaultHasher{}, ProxyOptions{}, nil)
+	server := httptest.NewServer(forward)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse(server.URL)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertificatePEM())
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: roots}}
+	defer transport.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", "https://api.example.com/hello", nil)
+	req.Header.Set("chameleon-request-hash", "abcdef12345")
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if string(body) != "Hello, HTTPS!" {
+		t.Errorf("Got: `%v`; Expected: `%v`", string(body), "Hello, HTTPS!")
+	}
+	if names := resp.TLS.PeerCertificates[0].DNSNames; len(names) != 1 || names[0] != "api.example.com" {
+		t.Errorf("Got: `%v`; Expected: `%v`", names, []string{"api.example.com"})
+	}
+	if created != "api.example.com" {
+		t.Errorf("Got: `%v`; Expected: `%v`", created, "api.example.com")
+	}
+}
+
+func TestForwardProxyRefusesConnectWithoutCA(t *testing.T) {
+	forward := NewForwardProxy("", nil, nil, DefaultHasher{}, ProxyOptions{}, nil)
+
+	w := httptest.NewRecorder()
+	forward.ServeHTTP(w, httptest.NewRequest("CONNECT", "api.example.com:443", nil))
+	if w.Code != 405 {
+		t.Errorf("Got: `%v`; Expected: `%v`", w.Code, 405)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Values of the chameleon-cache response header
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheSeeded = "SEEDED"
+)
+
+// cacheStatus returns the chameleon-cache header value for a cached response.
+func cacheStatus(response *CachedResponse) string {
+	if response.Seeded {
+		return cacheSeeded
+	}
+	return cacheHit
+}
+
+// addForwardedHeaders adds the X-Forwarded-* and Via headers to a request being proxied, where host is the Host
+// the client sent it to. X-Forwarded-Host and X-Forwarded-Proto set by another proxy in front of chameleon are kept.
+func addForwardedHeaders(r *http.Request, host string) {
+	if client, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			client = prior + ", " + client
+		}
+		r.Header.Set("X-Forwarded-For", client)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", host)
+	}
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	r.Header.Add("Via", fmt.Sprintf("%d.%d chameleon", r.ProtoMajor, r.ProtoMinor))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAddForwardedHeaders(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	req.RemoteAddr = "10.0.0.2:5000"
+	addForwardedHeaders(req, "localhost:6005")
+
+	expected := map[string]string{
+		"X-Forwarded-For":   "10.0.0.2",
+		"X-Forwarded-Host":  "localhost:6005",
+		"X-Forwarded-Proto": "http",
+		"Via":               "1.1 chameleon",
+	}
+	for name, value := range expected {
+		if req.Header.Get(name) != value {
+			t.Errorf("Got: `%v`; Expected: `%v` for %v", req.Header.Get(name), value, name)
+		}
+	}
+
+	// Headers from a proxy in front of chameleon are kept
+	req, _ = http.NewRequest("GET", "/foo", nil)
+	req.RemoteAddr = "10.0.0.2:5000"
+	req.Header.Set("X-Forwarded-For", "192.168.1.1")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Via", "1.1 frontend")
+	addForwardedHeaders(req, "localhost:6005")
+
+	expected = map[string]string{
+		"X-Forwarded-For":   "192.168.1.1, 10.0.0.2",
+		"X-Forwarded-Host":  "example.com",
+		"X-Forwarded-Proto": "https",
+	}
+	for name, value := range expected {
+		if req.Header.Get(name) != value {
+			t.Errorf("Got: `%v`; Expected: `%v` for %v", req.Header.Get(name), value, name)
+		}
+	}
+	if via := req.Header["Via"]; len(via) != 2 || via[1] != "1.1 chameleon" {
+		t.Errorf("Got: `%v`; Expected chameleon to be added to Via", via)
+	}
+}
+
+func TestCachedProxyHandlerForwardedHeaders(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer upstream.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	for _, enabled := range []bool{true, false} {
+		cache := mockCacher{data: make(map[string]*CachedResponse)}
+		handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{ForwardedHeaders: enabled})
+		req, _ := http.NewRequest("GET", "/foo", nil)
+		req.Host = "localhost:6005"
+		req.RemoteAddr = "10.0.0.2:5000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if actual := received.Get("X-Forwarded-Host") == "localhost:6005"; actual != enabled {
+			t.Errorf("Got: `%v`; Expected forwarded headers: `%v`", received, enabled)
+		}
+		if w.Header().Get("chameleon-request-hash") != (DefaultHasher{}).Hash(httptest.NewRequest("GET", "/foo", nil)) {
+			t.Errorf("Expected forwarded headers not to change the hash")
+		}
+	}
+}
+
+func TestCachedProxyHandlerCacheStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := mockCacher{data: map[string]*CachedResponse{
+		"seeded": {StatusCode: 200, Seeded: true},
+	}}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{})
+
+	for _, test := range []struct{ hash, expected string }{
+		{"recorded", cacheMiss},
+		{"recorded", cacheHit},
+		{"seeded", cacheSeeded},
+	} {
+		req, _ := http.NewRequest("GET", "/foo", nil)
+		req.Header.Set("chameleon-request-hash", test.hash)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Header().Get("chameleon-cache") != test.expected {
+			t.Errorf("Got: `%v`; Expected: `%v` for %v", w.Header().Get("chameleon-cache"), test.expected, test.hash)
+		}
+	}
+}
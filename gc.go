@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// referencedFiles returns the content files referred to by entries in spec.json.
+// An error is returned if any entry can't be decoded, as its content file is unknown.
+func (c *DiskCacher) referencedFiles() (map[string]bool, error) {
+	specs, problems, err := c.readSpecs()
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return referenceSpecs(specs), nil
+}
+
+// orphanedFiles returns the files in the data directory which no entry refers to.
+// spec.json, usage.json and hidden files (e.g. .gitkeep) are never orphaned.
+// Directories with a spec.json of their own (e.g. each host's recordings in forward proxy mode) are separate
+// data directories, and are skipped.
+func (c *DiskCacher) orphanedFiles(referenced map[string]bool) ([]string, error) {
+	files, err := c.FileSystem.ListFiles(c.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	specName := path.Base(c.specPath)
+	var nested []string
+	for _, file := range files {
+		if dir := path.Dir(file); path.Base(file) == specName && dir != "." {
+			nested = append(nested, dir+"/")
+		}
+	}
+
+	var orphaned []string
+	for _, file := range files {
+		switch file {
+		case specName, path.Base(c.usagePath):
+			continue
+		}
+		if strings.HasPrefix(path.Base(file), ".") || inNestedDir(file, nested) {
+			continue
+		}
+		if !referenced[file] {
+			orphaned = append(orphaned, file)
+		}
+	}
+	return orphaned, nil
+}
+
+// inNestedDir reports whether file is inside any of dirs, which end with a slash.
+func inNestedDir(file string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(file, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// CollectGarbage removes the files in the data directory which no entry refers to, and returns their names.
+// Nothing is removed if spec.json has entries which can't be decoded.
+func (c *DiskCacher) CollectGarbage(dryRun bool) ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+
+	referenced, err := c.referencedFiles()
+	if err != nil {
+		return nil, err
+	}
+	orphaned, err := c.orphanedFiles(referenced)
+	if err != nil || dryRun {
+		return orphaned, err
+	}
+
+	for i, file := range orphaned {
+		err = c.removeFile(file)
+		if err != nil {
+			return orphaned[:i], err
+		}
+	}
+	return orphaned, nil
+}
+
+func gcCommand(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	dryRun := flags.Bool("dry-run", false, "List the files which would be removed, without removing them")
+	flags.Usage = func() {
+		fmt.Fprintln(stdout, "Usage: chameleon gc [-dry-run] DIR...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	status := 0
+	for _, dir := range flags.Args() {
+		removed, err := NewDiskCacher(dir).CollectGarbage(*dryRun)
+		for _, file := range removed {
+			fmt.Fprintf(stdout, "%v: %v %v\n", dir, verb, file)
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "%v: error: %v\n", dir, err)
+			status = 1
+		}
+	}
+	return status
+}
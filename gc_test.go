@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskCacherCollectGarbage(t *testing.T) {
+	fs := mapFileSystem{
+		"data/spec.json":  []byte(`[{"key": "key", "response": {"status_code": 200, "content": "./used"}}]`),
+		"data/usage.json": []byte(`{}`),
+		"data/used":       []byte("USED"),
+		"data/orphan":     []byte("ORPHAN"),
+		"data/.gitkeep":   []byte(""),
+	}
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+
+	removed, err := cacher.CollectGarbage(true)
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if strings.Join(removed, ",") != "orphan" {
+		t.Errorf("Got: `%v`; Expected: `orphan`", removed)
+	}
+	if _, ok := fs["data/orphan"]; !ok {
+		t.Errorf("File was removed during a dry run")
+	}
+
+	removed, _ = cacher.CollectGarbage(false)
+	if strings.Join(removed, ",") != "orphan" {
+		t.Errorf("Got: `%v`; Expected: `orphan`", removed)
+	}
+	if len(fs) != 4 {
+		t.Errorf("Got: `%v`; Expected only the orphaned file to be removed", fs)
+	}
+}
+
+func TestDiskCacherCollectGarbageUndecodableEntry(t *testing.T) {
+	fs := mapFileSystem{
+		"data/spec.json": []byte(`[{"key": "key", "response": {"status_code": "200", "content": "used"}}]`),
+		"data/used":      []byte("USED"),
+	}
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+
+	_, err := cacher.CollectGarbage(false)
+	if err == nil {
+		t.Errorf("Expected an error for an entry which can't be decoded")
+	}
+	if _, ok := fs["data/used"]; !ok {
+		t.Errorf("Content file of an undecodable entry was removed")
+	}
+}
+
+func TestGCCommand(t *testing.T) {
+	var out bytes.Buffer
+	status := gcCommand([]string{"-dry-run", "./example/testing_data"}, &out)
+	if status != 0 || out.Len() != 0 {
+		t.Errorf("Got: `%v`; Expected: `0` with no output\n%v", status, out.String())
+	}
+
+	status = gcCommand([]string{}, &out)
+	if status != 2 {
+		t.Errorf("Got: `%v`; Expected: `2`", status)
+	}
+}
+
+func TestGCCommandForwardProxyLayout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello"))
+	}))
+	defer upstream.Close()
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+
+	forward := NewForwardProxy(dir, nil, func(dir string) (*DiskCacher, error) {
+		return NewDiskCacher(dir), nil
+	}, DefaultHasher{}, ProxyOptions{}, nil)
+	forward.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", upstream.URL+"/hello", nil))
+	_ = ioutil.WriteFile(filepath.Join(dir, "orphan"), []byte("ORPHAN"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, caKeyFile), []byte("KEY"), 0600)
+	if specs, _ := filepath.Glob(filepath.Join(dir, "*", "spec.json")); len(specs) != 1 {
+		t.Fatalf("Got: `%v`; Expected the host's recordings in a directory of their own", specs)
+	}
+
+	var out bytes.Buffer
+	if status := gcCommand([]string{"-dry-run", dir}, &out); status != 0 {
+		t.Fatalf("Got: `%v`; Expected: `%v` (%v)", status, 0, out.String())
+	}
+	if expected := dir + ": would remove " + caKeyFile + "\n" + dir + ": would remove orphan\n"; out.String() != expected {
+		t.Errorf("Got: `%v`; Expected: `%v`", out.String(), expected)
+	}
+}
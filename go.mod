@@ -0,0 +1,3 @@
+module github.com/nickpresta/chameleon
+
+go 1.24
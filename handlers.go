@@ -9,9 +9,38 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// hopHeaders are the hop-by-hop headers defined in RFC 7230, which only apply to a single connection.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from header, including any listed in its Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
 type preseedResponse struct {
 	Request struct {
 		Body   string
@@ -75,15 +104,180 @@ func PreseedHandler(cacher Cacher, hasher Hasher) http.HandlerFunc {
 	}
 }
 
+// A Reloader is used to refresh a cache from its backing store.
+type Reloader interface {
+	Reload() error
+}
+
+// ReloadHandler reloads a Reloader on demand
+func ReloadHandler(reloader Reloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(405)
+			return
+		}
+
+		log.Printf("-> Reloading cache\n")
+		err := reloader.Reload()
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprint(w, err)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+// A Pruner is used to remove unused entries from a cache.
+type Pruner interface {
+	Prune(opts PruneOptions) ([]string, error)
+}
+
+// PruneHandler prunes a Pruner according to the query string,
+// e.g. `?unused=true` or `?older_than=720h`, optionally with `&dry_run=true`
+func PruneHandler(pruner Pruner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(405)
+			return
+		}
+
+		query := r.URL.Query()
+		opts := PruneOptions{
+			Unused: query.Get("unused") == "true",
+			DryRun: query.Get("dry_run") == "true",
+		}
+		if olderThan := query.Get("older_than"); olderThan != "" {
+			duration, err := time.ParseDuration(olderThan)
+			if err != nil {
+				w.WriteHeader(400)
+				fmt.Fprint(w, err)
+				return
+			}
+			opts.OlderThan = duration
+		}
+		if !opts.Unused && opts.OlderThan == 0 {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "One of `unused` or `older_than` is required")
+			return
+		}
+
+		log.Printf("-> Pruning cache [unused: %v; older than: %v; dry run: %v]\n", opts.Unused, opts.OlderThan, opts.DryRun)
+		removed, err := pruner.Prune(opts)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprint(w, err)
+			return
+		}
+
+		if removed == nil {
+			removed = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		_ = json.NewEncoder(w).Encode(struct {
+			Removed []string `json:"removed"`
+		}{removed})
+	}
+}
+
+// FaultsHandler lists the faults injected by a FaultInjector on GET, replaces them with a JSON list on PUT,
+// and removes them all on DELETE
+func FaultsHandler(injector *FaultInjector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "PUT":
+			var faults []Fault
+			err := json.NewDecoder(r.Body).Decode(&faults)
+			if err == nil {
+				err = injector.SetFaults(faults)
+			}
+			if err != nil {
+				w.WriteHeader(400)
+				fmt.Fprint(w, err)
+				return
+			}
+			log.Printf("-> Injecting %d faults\n", len(faults))
+		case "DELETE":
+			// This never fails for an empty list
+			_ = injector.SetFaults(nil)
+			log.Printf("-> Removed all faults\n")
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			w.WriteHeader(405)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		_ = json.NewEncoder(w).Encode(injector.Faults())
+	}
+}
+
+// ProxyOptions configures a CachedProxyHandler.
+type ProxyOptions struct {
+	// MaxRecordSize is the largest response body, in bytes, which will be recorded.
+	// Larger responses are still proxied, but not cached. Zero means no limit.
+	MaxRecordSize int64
+	// EventDelayScale scales the delays between events when replaying text/event-stream responses and
+	// WebSocket connections, e.g. 1 for the original timing or 0.5 for twice as fast. Zero replays every event immediately.
+	EventDelayScale float64
+	// Latency decides how long to take to replay cached responses, unless a route in RouteLatency matches
+	Latency      LatencyPolicy
+	RouteLatency []LatencyRoute
+	// Faults injects faults into responses, both cached and not. It may be nil.
+	Faults *FaultInjector
+	// RateLimits answers requests over their route's rate limit with a 429, whether or not they are cached.
+	// It may be nil.
+	RateLimits *RateLimiter
+	// ForwardedHeaders adds X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and Via headers to proxied requests
+	ForwardedHeaders bool
+	// RewriteURLs replaces the proxied URL with PublicURL in the Location, Content-Location and Link headers
+	// of responses, and also in text bodies if RewriteBodies is set. Without a PublicURL, the address
+	// requests were sent to is used.
+	RewriteURLs   bool
+	RewriteBodies bool
+	PublicURL     *url.URL
+	// RewriteCookies removes the Domain of cookies set by responses, so browsers keep them for chameleon's address.
+	// Unless PublicURL (or the request) uses HTTPS, Secure is removed too, and SameSite=None becomes Lax.
+	RewriteCookies bool
+	// Client sends requests to the proxied service. It may be nil, to use a client with the default settings.
+	Client *http.Client
+}
+
+// client returns the client to send requests to the proxied service with.
+func (o ProxyOptions) client() *http.Client {
+	if o.Client == nil {
+		return defaultClient
+	}
+	return o.Client
+}
+
 // CachedProxyHandler proxies a given URL and stores/fetches content from a Cacher, according to a Hasher
-func CachedProxyHandler(serverURL *url.URL, cacher Cacher, hasher Hasher) http.HandlerFunc {
+func CachedProxyHandler(serverURL *url.URL, cacher Cacher, hasher Hasher, options ProxyOptions) http.HandlerFunc {
 	parsedURL, err := url.Parse(serverURL.String())
 	if err != nil {
 		panic(err)
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		if !options.RateLimits.limit(w, r) {
+			return
+		}
+		w = options.Faults.inject(w, r)
+		if w == nil {
+			return
+		}
+
+		rewriter := newURLRewriter(parsedURL, r, options)
+		cookies := newCookieRewriter(r, options)
+
 		// Change the host for the request for this configuration
+		clientHost := r.Host
 		r.Host = parsedURL.Host
 		r.URL.Host = r.Host
 		r.URL.Scheme = parsedURL.Scheme
@@ -94,27 +288,127 @@ func CachedProxyHandler(serverURL *url.URL, cacher Cacher, hasher Hasher) http.H
 			hash = hasher.Hash(r)
 		}
 		response := cacher.Get(hash)
+		if options.ForwardedHeaders {
+			// Added after hashing, so they don't change the hash
+			addForwardedHeaders(r, clientHost)
+		}
 
-		if response != nil {
-			log.Printf("-> Proxying [cached: %v] to %v\n", hash, r.URL)
-		} else {
-			// We don't have a cached response yet
-			log.Printf("-> Proxying [not cached: %v] to %v\n", hash, r.URL)
+		if isWebSocketUpgrade(r) {
+			if response == nil {
+				log.Printf("-> Proxying WebSocket [not cached: %v] to %v\n", hash, r.URL)
+				recordWebSocket(w, r, hash, cacher, options.client())
+			} else {
+				log.Printf("-> Replaying WebSocket [cached: %v] for %v\n", hash, r.URL)
+				replayWebSocket(w, r, hash, response, options.EventDelayScale)
+			}
+			return
+		}
 
-			// Create a recorder, so we can get data out and modify it (if needed)
-			rec := httptest.NewRecorder()
-			ProxyHandler(rec, r) // Actually call our handler
+		if response == nil {
+			// We don't have a cached response yet, so stream it to the client while recording it
+			log.Printf("-> Proxying [not cached: %v] to %v\n", hash, r.URL)
+			if rewriter != nil && rewriter.bodies {
+				// Ask for unencoded responses, so their bodies can be rewritten as they are streamed.
+				// Replays still encode them as the client's Accept-Encoding allows.
+				r.Header.Del("Accept-Encoding")
+			}
+			recordResponse(w, r, hash, cacher, options, rewriter, cookies)
+			return
+		}
+		log.Printf("-> Proxying [cached: %v] to %v\n", hash, r.URL)
 
-			response = cacher.Put(hash, rec)
+		body, err := response.BodyReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		defer func() {
+			// If this fails, there isn't much to do
+			_ = body.Close()
+		}()
+
+		firstByte, total := options.latencyPolicy(r.URL.Path).delays(response.Latency)
+		time.Sleep(firstByte - time.Since(started))
 
+		header := make(http.Header)
 		for k, v := range response.Headers {
-			w.Header().Add(k, v)
+			if http.CanonicalHeaderKey(k) == "Set-Cookie" {
+				// Several cookies are joined into one value when they are recorded
+				for _, cookie := range splitSetCookie(v) {
+					header.Add(k, cookie)
+				}
+				continue
+			}
+			header.Add(k, v)
+		}
+		// Recordings made by older versions, or by hand, may have hop-by-hop headers
+		removeHopHeaders(header)
+		hasBody := r.Method != "HEAD" && response.StatusCode != 204 && response.StatusCode != 304
+		rewriteBody := false
+		if rewriter != nil {
+			rewriter.rewriteHeaders(header)
+			rewriteBody = rewriter.rewritesBody(header)
 		}
+		if cookies != nil {
+			cookies.rewriteHeaders(header)
+		}
+
+		// Bodies are stored decoded, so encode them again if the client accepts it
+		encoding := ""
+		if response.Encoding != "" {
+			encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"), response.Encoding)
+			if encoding != "" {
+				header.Set("Content-Encoding", encoding)
+			}
+			if !headerContainsToken(header, "Vary", "Accept-Encoding") {
+				header.Add("Vary", "Accept-Encoding")
+			}
+		}
+		if header.Get("Content-Length") != "" && hasBody {
+			// The body may have been edited since it was recorded, so the recorded length can't be trusted
+			header.Del("Content-Length")
+			if encoding == "" && !rewriteBody {
+				if response.open == nil {
+					header.Set("Content-Length", strconv.Itoa(len(response.Body)))
+				} else if length, ok := bodyLength(body); ok {
+					header.Set("Content-Length", strconv.FormatInt(length, 10))
+				}
+			}
+		}
+		copyHeaders(w.Header(), header)
 		w.Header().Add("chameleon-request-hash", hash)
+		w.Header().Set("chameleon-cache", cacheStatus(response))
 		w.WriteHeader(response.StatusCode)
+
+		out := w
+		if encoding != "" && hasBody {
+			encoder := newEncodingWriter(w, encoding)
+			defer func() {
+				// If this fails, there isn't much to do
+				_ = encoder.Close()
+			}()
+			out = encoder
+		}
+		if rewriteBody && hasBody {
+			rewriting := &rewritingWriter{ResponseWriter: out, rewriter: rewriter}
+			defer func() {
+				// If this fails, there isn't much to do
+				_ = rewriting.Close()
+			}()
+			out = rewriting
+		}
 		// If this fails, there isn't much to do
-		_, _ = io.Copy(w, bytes.NewReader(response.Body))
+		if len(response.Events) > 0 {
+			_ = replayEvents(out, body, response.Events, options.EventDelayScale)
+			return
+		}
+		if total > firstByte {
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			time.Sleep(total - time.Since(started))
+		}
+		_, _ = io.Copy(out, body)
 	}
 }
 
@@ -128,19 +422,33 @@ func copyHeaders(dst, src http.Header) {
 
 // ProxyHandler implements a standard HTTP handler to proxy a given request and returns the response
 func ProxyHandler(w http.ResponseWriter, r *http.Request) {
-	client := &http.Client{}
-	resp, err := client.Do(r)
+	// If this fails, there isn't much to do
+	_ = proxy(w, r, defaultClient)
+}
+
+// proxy sends r upstream and copies the response to w.
+// If the service can't be reached, the error is sent to the client as a 500 and also returned, so it isn't recorded.
+// An error is also returned if the body couldn't be copied in full.
+func proxy(w http.ResponseWriter, r *http.Request, client *http.Client) error {
+	// Hop-by-hop headers only apply to the connection from the client
+	out := r.WithContext(r.Context())
+	out.Header = make(http.Header)
+	copyHeaders(out.Header, r.Header)
+	removeHopHeaders(out.Header)
+
+	resp, err := client.Do(out)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	defer func() {
 		// If this fails, there isn't much to do
 		_ = resp.Body.Close()
 	}()
+	removeHopHeaders(resp.Header)
 	copyHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	// If this fails, there isn't much to do
-	_, _ = io.Copy(w, resp.Body) // Proxy through
+	_, err = io.Copy(w, resp.Body) // Proxy through
+	return err
 }
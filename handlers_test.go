@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -44,12 +45,29 @@ func (m mockCacher) Put(key string, r *httptest.ResponseRecorder) *CachedRespons
 	return m.data[key]
 }
 
+func (m mockCacher) Record(key string, rec *Recording) (*CachedResponse, error) {
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.data[key] = &CachedResponse{
+		StatusCode: rec.StatusCode,
+		Body:       body,
+		Headers:    flattenHeaders(rec.Header),
+		Events:     rec.Events,
+		Frames:     rec.Frames,
+		Latency:    rec.Latency,
+		Encoding:   rec.Encoding,
+	}
+	return m.data[key], nil
+}
+
 func TestCachedProxyHandler(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("Foo", fakeResp.Headers["Foo"])
 		w.WriteHeader(fakeResp.StatusCode)
-		fmt.Fprintf(w, string(fakeResp.Body))
+		fmt.Fprint(w, string(fakeResp.Body))
 	}))
 	defer server.Close()
 
@@ -58,6 +76,7 @@ func TestCachedProxyHandler(t *testing.T) {
 		serverURL,
 		mockCacher{data: make(map[string]*CachedResponse)},
 		DefaultHasher{},
+		ProxyOptions{},
 	)
 
 	w := httptest.NewRecorder()
@@ -102,6 +121,7 @@ func TestPreseedHandler(t *testing.T) {
 		serverURL,
 		cache,
 		DefaultHasher{},
+		ProxyOptions{},
 	)
 	preseedHandler := PreseedHandler(
 		cache,
@@ -171,6 +191,7 @@ func TestPreseedHandlerWithRequestBody(t *testing.T) {
 		serverURL,
 		cache,
 		DefaultHasher{},
+		ProxyOptions{},
 	)
 	preseedHandler := PreseedHandler(
 		cache,
@@ -306,3 +327,175 @@ func TestPreseedHandlerBadURL(t *testing.T) {
 		t.Errorf("Hash was returned for bad url.")
 	}
 }
+
+type mockReloader struct {
+	err   error
+	calls *int
+}
+
+func (m mockReloader) Reload() error {
+	*m.calls++
+	return m.err
+}
+
+func TestReloadHandler(t *testing.T) {
+	calls := 0
+	reloadHandler := ReloadHandler(mockReloader{calls: &calls})
+
+	req, _ := http.NewRequest("POST", "/_reload", nil)
+	w := httptest.NewRecorder()
+	reloadHandler.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("Got: `%v`; Expected: `200`", w.Code)
+	}
+	if calls != 1 {
+		t.Errorf("Got: `%v` reloads; Expected: `1`", calls)
+	}
+}
+
+func TestReloadHandlerError(t *testing.T) {
+	calls := 0
+	reloadHandler := ReloadHandler(mockReloader{err: fmt.Errorf("SOMETHING BROKE"), calls: &calls})
+
+	req, _ := http.NewRequest("POST", "/_reload", nil)
+	w := httptest.NewRecorder()
+	reloadHandler.ServeHTTP(w, req)
+
+	if w.Code != 500 {
+		t.Errorf("Got: `%v`; Expected: `500`", w.Code)
+	}
+	if w.Body.String() != "SOMETHING BROKE" {
+		t.Errorf("Got: `%v`; Expected: `SOMETHING BROKE`", w.Body.String())
+	}
+}
+
+func TestReloadHandlerRequiresPost(t *testing.T) {
+	calls := 0
+	reloadHandler := ReloadHandler(mockReloader{calls: &calls})
+
+	req, _ := http.NewRequest("GET", "/_reload", nil)
+	w := httptest.NewRecorder()
+	reloadHandler.ServeHTTP(w, req)
+
+	if w.Code != 405 {
+		t.Errorf("Got: `%v`; Expected: `405`", w.Code)
+	}
+	if calls != 0 {
+		t.Errorf("Got: `%v` reloads; Expected: `0`", calls)
+	}
+}
+
+type mockPruner struct {
+	opts *PruneOptions
+}
+
+func (m mockPruner) Prune(opts PruneOptions) ([]string, error) {
+	*m.opts = opts
+	return []string{"abc"}, nil
+}
+
+func TestPruneHandler(t *testing.T) {
+	var opts PruneOptions
+	pruneHandler := PruneHandler(mockPruner{opts: &opts})
+
+	req, _ := http.NewRequest("POST", "/_prune?unused=true&older_than=24h&dry_run=true", nil)
+	w := httptest.NewRecorder()
+	pruneHandler.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("Got: `%v`; Expected: `200`", w.Code)
+	}
+	if !opts.Unused || opts.OlderThan != 24*time.Hour || !opts.DryRun {
+		t.Errorf("Got: `%+v`; Expected all options to be set", opts)
+	}
+	if strings.TrimSpace(w.Body.String()) != `{"removed":["abc"]}` {
+		t.Errorf("Got: `%v`; Expected: `{\"removed\":[\"abc\"]}`", w.Body.String())
+	}
+}
+
+func TestPruneHandlerBadOptions(t *testing.T) {
+	var opts PruneOptions
+	pruneHandler := PruneHandler(mockPruner{opts: &opts})
+
+	for _, query := range []string{"", "?older_than=forever"} {
+		req, _ := http.NewRequest("POST", "/_prune"+query, nil)
+		w := httptest.NewRecorder()
+		pruneHandler.ServeHTTP(w, req)
+
+		if w.Code != 400 {
+			t.Errorf("Got: `%v`; Expected: `400` for `%v`", w.Code, query)
+		}
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":        {"keep-alive, X-Private"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"X-Private":         {"secret"},
+		"Content-Type":      {"text/plain"},
+	}
+	removeHopHeaders(header)
+	if len(header) != 1 || header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Got: `%v`; Expected only `Content-Type`", header)
+	}
+}
+
+func TestProxyHandlerStripsHopHeaders(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "hop")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Upstream", "kept")
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "hop")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("X-Client", "kept")
+	w := httptest.NewRecorder()
+	ProxyHandler(w, req)
+
+	if received.Get("X-Client-Hop") != "" || received.Get("Proxy-Authorization") != "" || received.Get("X-Client") != "kept" {
+		t.Errorf("Got: `%v`; Expected hop-by-hop headers to be removed from the request", received)
+	}
+	if req.Header.Get("X-Client-Hop") != "hop" {
+		t.Errorf("Expected the original request to be left untouched")
+	}
+	if w.Header().Get("X-Upstream-Hop") != "" || w.Header().Get("Keep-Alive") != "" || w.Header().Get("X-Upstream") != "kept" {
+		t.Errorf("Got: `%v`; Expected hop-by-hop headers to be removed from the response", w.Header())
+	}
+}
+
+func TestCachedProxyHandlerFixesReplayedHeaders(t *testing.T) {
+	serverURL, _ := url.Parse("http://example.com")
+	cache := mockCacher{data: map[string]*CachedResponse{
+		"edited": {
+			StatusCode: 200,
+			Body:       []byte("edited by hand"),
+			Headers:    map[string]string{"Content-Length": "5", "Transfer-Encoding": "chunked", "Connection": "close"},
+		},
+	}}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{})
+
+	req, _ := http.NewRequest("GET", "/edited", nil)
+	req.Header.Set("chameleon-request-hash", "edited")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Header().Get("Content-Length") != "14" {
+		t.Errorf("Got: `%v`; Expected: `14`", w.Header().Get("Content-Length"))
+	}
+	if w.Header().Get("Transfer-Encoding") != "" || w.Header().Get("Connection") != "" {
+		t.Errorf("Got: `%v`; Expected hop-by-hop headers to be removed", w.Header())
+	}
+	if w.Body.String() != "edited by hand" {
+		t.Errorf("Got: `%v`; Expected: `edited by hand`", w.Body.String())
+	}
+}
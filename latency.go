@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Latency records how long upstream took to respond when a response was recorded.
+type Latency struct {
+	// FirstByte is the number of milliseconds before the response headers arrived
+	FirstByte int64 `json:"first_byte_ms"`
+	// Total is the number of milliseconds before the whole response arrived
+	Total int64 `json:"total_ms"`
+}
+
+// Latency policy modes
+const (
+	latencyInstant  = "instant"
+	latencyOriginal = "original"
+	latencyScaled   = "scaled"
+	latencyFixed    = "fixed"
+	latencyRandom   = "random"
+)
+
+// LatencyPolicy decides how long to take to replay a cached response.
+// The zero value replays responses instantly.
+type LatencyPolicy struct {
+	Mode string
+	// Scale multiplies the recorded latency, for scaled policies
+	Scale float64
+	// Min and Max bound the delay for fixed (Min only) and random policies
+	Min time.Duration
+	Max time.Duration
+}
+
+// ParseLatencyPolicy parses a latency policy: instant, original, scaled:N, fixed:DURATION or random:MIN-MAX
+// (e.g. scaled:0.5, fixed:200ms or random:100ms-2s).
+func ParseLatencyPolicy(s string) (LatencyPolicy, error) {
+	mode, arg := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		mode, arg = s[:i], s[i+1:]
+	}
+
+	policy := LatencyPolicy{Mode: mode}
+	var err error
+	switch mode {
+	case latencyInstant, latencyOriginal:
+		if arg != "" {
+			err = fmt.Errorf("%v takes no argument", mode)
+		}
+	case latencyScaled:
+		policy.Scale, err = strconv.ParseFloat(arg, 64)
+		if err == nil && policy.Scale < 0 {
+			err = fmt.Errorf("scale must not be negative")
+		}
+	case latencyFixed:
+		policy.Min, err = time.ParseDuration(arg)
+		policy.Max = policy.Min
+	case latencyRandom:
+		bounds := strings.SplitN(arg, "-", 2)
+		if len(bounds) != 2 {
+			err = fmt.Errorf("expected random:MIN-MAX")
+			break
+		}
+		policy.Min, err = time.ParseDuration(bounds[0])
+		if err == nil {
+			policy.Max, err = time.ParseDuration(bounds[1])
+		}
+		if err == nil && policy.Max < policy.Min {
+			err = fmt.Errorf("%v is less than %v", policy.Max, policy.Min)
+		}
+	default:
+		err = fmt.Errorf("expected instant, original, scaled:N, fixed:DURATION or random:MIN-MAX")
+	}
+	if err != nil {
+		return LatencyPolicy{}, fmt.Errorf("invalid latency policy %q: %v", s, err)
+	}
+	return policy, nil
+}
+
+// delays returns how long to wait before sending the headers and the body of a response,
+// both measured from when the request arrived.
+func (p LatencyPolicy) delays(recorded *Latency) (firstByte, total time.Duration) {
+	switch p.Mode {
+	case latencyOriginal, latencyScaled:
+		if recorded == nil {
+			return 0, 0
+		}
+		scale := 1.0
+		if p.Mode == latencyScaled {
+			scale = p.Scale
+		}
+		firstByte = time.Duration(float64(recorded.FirstByte)*scale) * time.Millisecond
+		total = time.Duration(float64(recorded.Total)*scale) * time.Millisecond
+		return firstByte, total
+	case latencyFixed:
+		return p.Min, p.Min
+	case latencyRandom:
+		delay := p.Min
+		if p.Max > p.Min {
+			delay += time.Duration(rand.Int63n(int64(p.Max - p.Min)))
+		}
+		return delay, delay
+	}
+	return 0, 0
+}
+
+// LatencyRoute applies a latency policy to requests whose path starts with Prefix.
+type LatencyRoute struct {
+	Prefix string
+	Policy LatencyPolicy
+}
+
+// parseLatencyRoutes parses the latency policy for each route given with -route-latency.
+func parseLatencyRoutes(routes routeFlag) ([]LatencyRoute, error) {
+	parsed := make([]LatencyRoute, len(routes))
+	for i, route := range routes {
+		policy, err := ParseLatencyPolicy(route.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", route.Prefix, err)
+		}
+		parsed[i] = LatencyRoute{Prefix: route.Prefix, Policy: policy}
+	}
+	return parsed, nil
+}
+
+// latencyPolicy returns the latency policy for the route with the longest prefix matching path,
+// or the default policy if no route matches.
+func (o ProxyOptions) latencyPolicy(path string) LatencyPolicy {
+	prefixes := make([]string, len(o.RouteLatency))
+	for i, route := range o.RouteLatency {
+		prefixes[i] = route.Prefix
+	}
+	if i := longestPrefix(path, prefixes); i >= 0 {
+		return o.RouteLatency[i].Policy
+	}
+	return o.Latency
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseLatencyPolicy(t *testing.T) {
+	valid := map[string]LatencyPolicy{
+		"instant":         {Mode: latencyInstant},
+		"original":        {Mode: latencyOriginal},
+		"scaled:0.5":      {Mode: latencyScaled, Scale: 0.5},
+		"fixed:200ms":     {Mode: latencyFixed, Min: 200 * time.Millisecond, Max: 200 * time.Millisecond},
+		"random:100ms-2s": {Mode: latencyRandom, Min: 100 * time.Millisecond, Max: 2 * time.Second},
+	}
+	for s, expected := range valid {
+		policy, err := ParseLatencyPolicy(s)
+		if err != nil {
+			t.Errorf("Unexpected error: `%v`", err)
+		}
+		if policy != expected {
+			t.Errorf("Got: `%+v`; Expected: `%+v`", policy, expected)
+		}
+	}
+
+	for _, s := range []string{"", "slow", "instant:1", "scaled:x", "scaled:-1", "fixed:soon", "random:1s", "random:2s-1s"} {
+		if _, err := ParseLatencyPolicy(s); err == nil {
+			t.Errorf("Expected an error for `%v`", s)
+		}
+	}
+}
+
+func TestLatencyPolicyDelays(t *testing.T) {
+	recorded := &Latency{FirstByte: 100, Total: 300}
+	tests := []struct {
+		policy    LatencyPolicy
+		recorded  *Latency
+		firstByte time.Duration
+		total     time.Duration
+	}{
+		{LatencyPolicy{}, recorded, 0, 0},
+		{LatencyPolicy{Mode: latencyOriginal}, recorded, 100 * time.Millisecond, 300 * time.Millisecond},
+		{LatencyPolicy{Mode: latencyOriginal}, nil, 0, 0},
+		{LatencyPolicy{Mode: latencyScaled, Scale: 2}, recorded, 200 * time.Millisecond, 600 * time.Millisecond},
+		{LatencyPolicy{Mode: latencyFixed, Min: time.Second, Max: time.Second}, nil, time.Second, time.Second},
+	}
+	for _, test := range tests {
+		firstByte, total := test.policy.delays(test.recorded)
+		if firstByte != test.firstByte || total != test.total {
+			t.Errorf("Got: `%v %v`; Expected: `%v %v` for `%+v`", firstByte, total, test.firstByte, test.total, test.policy)
+		}
+	}
+
+	random := LatencyPolicy{Mode: latencyRandom, Min: time.Second, Max: 2 * time.Second}
+	for i := 0; i < 10; i++ {
+		firstByte, total := random.delays(nil)
+		if firstByte < time.Second || firstByte >= 2*time.Second || total != firstByte {
+			t.Errorf("Got: `%v %v`; Expected a delay between 1s and 2s", firstByte, total)
+		}
+	}
+}
+
+func TestProxyOptionsLatencyPolicy(t *testing.T) {
+	fixed := LatencyPolicy{Mode: latencyFixed, Min: time.Second}
+	original := LatencyPolicy{Mode: latencyOriginal}
+	options := ProxyOptions{
+		Latency:      original,
+		RouteLatency: []LatencyRoute{{Prefix: "/orders", Policy: fixed}, {Prefix: "/orders/fast", Policy: LatencyPolicy{}}},
+	}
+	for path, expected := range map[string]LatencyPolicy{
+		"/orders/5":      fixed,
+		"/orders/fast/5": {},
+		"/users":         original,
+	} {
+		if actual := options.latencyPolicy(path); actual != expected {
+			t.Errorf("Got: `%+v`; Expected: `%+v` for `%v`", actual, expected, path)
+		}
+	}
+}
+
+func TestCachedProxyHandlerReplaysLatency(t *testing.T) {
+	serverURL, _ := url.Parse("http://example.com")
+	cache := mockCacher{data: map[string]*CachedResponse{
+		"slow": {StatusCode: 200, Body: []byte("slow"), Latency: &Latency{FirstByte: 20, Total: 60}},
+	}}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{
+		RouteLatency: []LatencyRoute{{Prefix: "/slow", Policy: LatencyPolicy{Mode: latencyOriginal}}},
+	})
+
+	for path, minimum := range map[string]time.Duration{"/slow": 60 * time.Millisecond, "/fast": 0} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("chameleon-request-hash", "slow")
+		w := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(w, req)
+		elapsed := time.Since(start)
+		if w.Body.String() != "slow" {
+			t.Errorf("Got: `%v`; Expected: `slow`", w.Body.String())
+		}
+		if elapsed < minimum || elapsed > minimum+time.Second {
+			t.Errorf("Got: `%v`; Expected about `%v` for `%v`", elapsed, minimum, path)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// bodyCache is a least recently used cache of response bodies, bounded by their total size in bytes.
+type bodyCache struct {
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List
+	mutex   *sync.Mutex
+}
+
+type bodyCacheEntry struct {
+	key  string
+	body []byte
+}
+
+func newBodyCache(maxSize int64) *bodyCache {
+	return &bodyCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		mutex:   new(sync.Mutex),
+	}
+}
+
+// Get returns the body cached for key, marking it as recently used.
+func (b *bodyCache) Get(key string) ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	element, ok := b.entries[key]
+	if !ok {
+		return nil, false
+	}
+	b.order.MoveToFront(element)
+	return element.Value.(*bodyCacheEntry).body, true
+}
+
+// Add caches body for key, evicting the least recently used bodies to make room.
+// Bodies larger than the cache are not cached.
+func (b *bodyCache) Add(key string, body []byte) {
+	if int64(len(body)) > b.maxSize {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if element, ok := b.entries[key]; ok {
+		b.order.MoveToFront(element)
+		return
+	}
+	b.entries[key] = b.order.PushFront(&bodyCacheEntry{key: key, body: body})
+	b.size += int64(len(body))
+
+	for b.size > b.maxSize {
+		oldest := b.order.Back()
+		entry := oldest.Value.(*bodyCacheEntry)
+		b.order.Remove(oldest)
+		delete(b.entries, entry.key)
+		b.size -= int64(len(entry.body))
+	}
+}
+
+// cachingReader adds everything read through it to a bodyCache once the end is reached,
+// as long as it fits in the cache.
+type cachingReader struct {
+	io.ReadCloser
+	key   string
+	cache *bodyCache
+	buf   *bytes.Buffer
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.buf != nil {
+		_, _ = r.buf.Write(p[:n])
+		if int64(r.buf.Len()) > r.cache.maxSize {
+			// Too big to cache, so stop buffering
+			r.buf = nil
+		}
+	}
+	if err == io.EOF && r.buf != nil {
+		r.cache.Add(r.key, r.buf.Bytes())
+		r.buf = nil
+	}
+	return n, err
+}
+
+// gzipReadCloser closes both a gzip reader and the file it reads from.
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (r gzipReadCloser) Close() error {
+	_ = r.Reader.Close()
+	return r.file.Close()
+}
+
+// openContent opens a content file from whichever layout it is stored in.
+func (c *DiskCacher) openContent(name string) (io.ReadCloser, error) {
+	var firstErr error
+	for _, layout := range contentLayouts(name) {
+		file, err := c.FileSystem.Open(path.Join(c.dataDir, layout))
+		if err == nil {
+			return file, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// lazyBody returns a function which streams the decompressed body of a content file from disk,
+// or from the body cache if it has been read recently.
+func (c *DiskCacher) lazyBody(name, compression string, bodies *bodyCache) func() (io.ReadCloser, error) {
+	cacheKey := compression + ":" + path.Clean(name)
+	return func() (io.ReadCloser, error) {
+		if bodies != nil {
+			if body, ok := bodies.Get(cacheKey); ok {
+				return memoryBody{bytes.NewReader(body)}, nil
+			}
+		}
+
+		file, err := c.openContent(name)
+		if err != nil {
+			return nil, err
+		}
+		var reader io.ReadCloser = file
+		if compression == gzipCompression {
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+			reader = gzipReadCloser{Reader: gz, file: file}
+		}
+
+		if bodies != nil {
+			reader = &cachingReader{ReadCloser: reader, key: cacheKey, cache: bodies, buf: new(bytes.Buffer)}
+		}
+		return reader, nil
+	}
+}
+
+// memoryBody is a body read from the body cache.
+type memoryBody struct {
+	*bytes.Reader
+}
+
+func (memoryBody) Close() error {
+	return nil
+}
+
+// bodyLength returns the length of a body returned by lazyBody, if it is known without reading it.
+// The length of a compressed content file is only known once it is in the body cache.
+func bodyLength(body io.ReadCloser) (int64, bool) {
+	switch body := body.(type) {
+	case memoryBody:
+		return body.Size(), true
+	case *cachingReader:
+		return bodyLength(body.ReadCloser)
+	case *os.File:
+		if info, err := body.Stat(); err == nil {
+			return info.Size(), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readBody(t *testing.T, response *CachedResponse) string {
+	body, err := response.BodyReader()
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	defer body.Close()
+	content, _ := ioutil.ReadAll(body)
+	return string(content)
+}
+
+func TestBodyCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newBodyCache(10)
+	cache.Add("a", []byte("AAAA"))
+	cache.Add("b", []byte("BBBB"))
+	cache.Get("a")
+	cache.Add("c", []byte("CCCC"))
+
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("Least recently used body was not evicted")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Errorf("Recently used body was evicted")
+	}
+	cache.Add("big", []byte("THIS IS TOO BIG"))
+	if _, ok := cache.Get("big"); ok {
+		t.Errorf("Body larger than the cache was cached")
+	}
+	if cache.size != 8 {
+		t.Errorf("Got: `%v`; Expected: `8`", cache.size)
+	}
+}
+
+func lazyFileSystem() mapFileSystem {
+	compressed, _ := compressContent([]byte("COMPRESSED"), gzipCompression)
+	return mapFileSystem{
+		"data/spec.json": []byte(`[
+    {"key": "plain", "response": {"status_code": 200, "content": "plain"}},
+    {"key": "gzip", "response": {"status_code": 200, "content": "compressed.gz", "compression": "gzip"}},
+    {"key": "missing", "response": {"status_code": 200, "content": "missing"}}
+]`),
+		"data/plain":         []byte("PLAIN"),
+		"data/compressed.gz": compressed,
+	}
+}
+
+func TestDiskCacherLazy(t *testing.T) {
+	fs := lazyFileSystem()
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+	cacher.Lazy = true
+
+	err := cacher.SeedCache()
+	if problems, ok := err.(SpecErrors); !ok || len(problems) != 1 {
+		t.Errorf("Got: `%v`; Expected a problem for the missing content file", err)
+	}
+
+	response := cacher.Get("plain")
+	if response.Body != nil {
+		t.Errorf("Body was loaded into memory")
+	}
+	fs["data/plain"] = []byte("CHANGED")
+	if body := readBody(t, response); body != "CHANGED" {
+		t.Errorf("Got: `%v`; Expected: `CHANGED`", body)
+	}
+	if body := readBody(t, cacher.Get("gzip")); body != "COMPRESSED" {
+		t.Errorf("Got: `%v`; Expected: `COMPRESSED`", body)
+	}
+}
+
+func TestDiskCacherLazyCache(t *testing.T) {
+	fs := lazyFileSystem()
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+	cacher.Lazy = true
+	cacher.LazyCacheSize = 1024
+	_ = cacher.SeedCache()
+
+	if body := readBody(t, cacher.Get("plain")); body != "PLAIN" {
+		t.Errorf("Got: `%v`; Expected: `PLAIN`", body)
+	}
+	delete(fs, "data/plain")
+	if body := readBody(t, cacher.Get("plain")); body != "PLAIN" {
+		t.Errorf("Got: `%v`; Expected the body to be served from memory", body)
+	}
+}
+
+func TestDiskCacherLazyPut(t *testing.T) {
+	fs := mapFileSystem{}
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+	cacher.Lazy = true
+	cacher.Sharded = true
+	cacher.Compression = gzipCompression
+
+	recorder := httptest.NewRecorder()
+	recorder.Code = 200
+	_, _ = recorder.WriteString("BODY")
+	_ = cacher.Put("key", recorder)
+
+	response := cacher.Get("key")
+	if response.Body != nil {
+		t.Errorf("Body was kept in memory")
+	}
+	if body := readBody(t, response); body != "BODY" {
+		t.Errorf("Got: `%v`; Expected: `BODY`", body)
+	}
+}
+
+func TestCachedProxyHandlerLazyContentLength(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	spec := `[{"key": "key", "response": {"status_code": 200, "content": "hello", "headers": {"Content-Length": "3"}}}]`
+	_ = ioutil.WriteFile(filepath.Join(dir, "spec.json"), []byte(spec), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "hello"), []byte("HELLO"), 0644)
+	cacher := NewDiskCacher(dir)
+	cacher.Lazy = true
+	cacher.LazyCacheSize = 100
+	if err := cacher.SeedCache(); err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+
+	serverURL, _ := url.Parse("http://example.com")
+	handler := CachedProxyHandler(serverURL, cacher, DefaultHasher{}, ProxyOptions{})
+	// Read from the content file, then from the body cache
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/hello", nil)
+		req.Header.Set("chameleon-request-hash", "key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if length := w.Header().Get("Content-Length"); length != "5" || w.Body.String() != "HELLO" {
+			t.Errorf("Got: `%v`, `%v`; Expected: `5`, `HELLO`", length, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A LintResult holds the problems found in a data directory.
+// Errors stop entries from being served; warnings are suspicious but harmless.
+type LintResult struct {
+	Errors   []string
+	Warnings []string
+}
+
+func (l *LintResult) errorf(format string, args ...interface{}) {
+	l.Errors = append(l.Errors, fmt.Sprintf(format, args...))
+}
+
+func (l *LintResult) warnf(format string, args ...interface{}) {
+	l.Warnings = append(l.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Lint checks the data directory of a DiskCacher, loading it the same way SeedCache does.
+// An error is returned if spec.json can't be parsed at all.
+func Lint(c *DiskCacher) (*LintResult, error) {
+	result := &LintResult{}
+
+	cache, problems, err := c.readCache(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, problem := range problems {
+		result.errorf("%v", problem)
+	}
+
+	specs, _, _ := c.readSpecs()
+	orphaned, err := c.orphanedFiles(referenceSpecs(specs))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range orphaned {
+		if path.Base(file) == caKeyFile {
+			result.warnf("%q looks like the key of chameleon's CA, which should be kept out of the data directory "+
+				"(see -ca-dir); remove it with `chameleon gc`", file)
+			continue
+		}
+		result.warnf("orphaned file %q is not referenced by any entry, remove it with `chameleon gc`", file)
+	}
+
+	keys := make([]string, 0, len(cache))
+	for key := range cache {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lintHeaders(result, key, cache[key])
+	}
+
+	lintFormatting(result, c.readSpecContent())
+
+	return result, nil
+}
+
+func lintHeaders(result *LintResult, key string, response *CachedResponse) {
+	for name, value := range response.Headers {
+		if canonical := http.CanonicalHeaderKey(name); canonical != name {
+			result.warnf("key %q: header %q is not in canonical form (%q)", key, name, canonical)
+		}
+		for _, hop := range hopHeaders {
+			if strings.EqualFold(name, hop) {
+				result.warnf("key %q: hop-by-hop header %q should not be recorded", key, name)
+			}
+		}
+		// HEAD, 204 and 304 responses have a Content-Length without a body. The spec doesn't have the method,
+		// so any response without a body is given the benefit of the doubt.
+		if strings.EqualFold(name, "Content-Length") && len(response.Body) > 0 {
+			length, err := strconv.Atoi(value)
+			if err != nil || length != len(response.Body) {
+				result.warnf("key %q: stale Content-Length %q, content is %d bytes", key, value, len(response.Body))
+			}
+		}
+	}
+}
+
+func lintFormatting(result *LintResult, content []byte) {
+	var specs []json.RawMessage
+	if json.Unmarshal(content, &specs) != nil {
+		return
+	}
+	canonical, err := json.MarshalIndent(specs, "", "    ")
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(bytes.TrimRight(content, "\n"), canonical) {
+		result.warnf("spec.json is not canonically formatted (4 space indentation, as written by chameleon)")
+	}
+}
+
+func lintCommand(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	strict := flags.Bool("strict", false, "Treat warnings as errors")
+	flags.Usage = func() {
+		fmt.Fprintln(stdout, "Usage: chameleon lint [-strict] DIR...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	status := 0
+	for _, dir := range flags.Args() {
+		result, err := Lint(NewDiskCacher(dir))
+		if err != nil {
+			fmt.Fprintf(stdout, "%v: error: %v\n", dir, err)
+			status = 1
+			continue
+		}
+		for _, msg := range result.Errors {
+			fmt.Fprintf(stdout, "%v: error: %v\n", dir, msg)
+		}
+		for _, msg := range result.Warnings {
+			fmt.Fprintf(stdout, "%v: warning: %v\n", dir, msg)
+		}
+		if len(result.Errors) > 0 || (*strict && len(result.Warnings) > 0) {
+			status = 1
+		}
+	}
+	return status
+}
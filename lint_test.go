@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func lintCacher(fs mapFileSystem) *DiskCacher {
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+	return cacher
+}
+
+func TestLint(t *testing.T) {
+	specs := `[
+    {"key": "good", "response": {"status_code": 200, "content": "good", "headers": {"Content-Length": "3", "Connection": "keep-alive", "content-type": "text/plain"}}},
+    {"key": "missing", "response": {"status_code": 200, "content": "missing"}}
+]`
+	result, err := Lint(lintCacher(mapFileSystem{
+		"data/spec.json": []byte(specs),
+		"data/good":      []byte("GOOD"),
+		"data/orphan":    []byte("ORPHAN"),
+		"data/.gitkeep":  []byte(""),
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0], "missing") {
+		t.Errorf("Got: `%v`; Expected an error for the missing content file", result.Errors)
+	}
+	expected := []string{"orphaned file \"orphan\"", "Connection", "content-type", "stale Content-Length", "canonically formatted"}
+	warnings := strings.Join(result.Warnings, "\n")
+	for _, e := range expected {
+		if !strings.Contains(warnings, e) {
+			t.Errorf("Got: `%v`; Expected a warning containing `%v`", warnings, e)
+		}
+	}
+	if len(result.Warnings) != len(expected) {
+		t.Errorf("Got: `%v` warnings; Expected: `%v`", len(result.Warnings), len(expected))
+	}
+}
+
+func TestLintClean(t *testing.T) {
+	specs := `[
+    {
+        "response": {
+            "status_code": 200,
+            "content": "good",
+            "headers": {
+                "Content-Length": "4"
+            }
+        },
+        "key": "good"
+    }
+]
+`
+	result, err := Lint(lintCacher(mapFileSystem{
+		"data/spec.json": []byte(specs),
+		"data/good":      []byte("GOOD"),
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if len(result.Errors) != 0 || len(result.Warnings) != 0 {
+		t.Errorf("Got: `%v`, `%v`; Expected no problems", result.Errors, result.Warnings)
+	}
+}
+
+func TestLintCAKey(t *testing.T) {
+	result, err := Lint(lintCacher(mapFileSystem{
+		"data/spec.json":    []byte("[]"),
+		"data/" + caKeyFile: []byte("KEY"),
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "key of chameleon's CA") {
+		t.Errorf("Got: `%v`; Expected a warning about the CA key", result.Warnings)
+	}
+}
+
+func TestLintBodilessContentLength(t *testing.T) {
+	specs := `[
+    {
+        "response": {
+            "status_code": 304,
+            "content": "empty",
+            "headers": {
+                "Content-Length": "1024"
+            }
+        },
+        "key": "not-modified"
+    }
+]
+`
+	result, err := Lint(lintCacher(mapFileSystem{
+		"data/spec.json": []byte(specs),
+		"data/empty":     []byte(""),
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if len(result.Errors) != 0 || len(result.Warnings) != 0 {
+		t.Errorf("Got: `%v`, `%v`; Expected no problems", result.Errors, result.Warnings)
+	}
+}
+
+func TestLintMalformedSpecs(t *testing.T) {
+	_, err := Lint(lintCacher(mapFileSystem{"data/spec.json": []byte("[{]")}))
+	if err == nil {
+		t.Errorf("Expected an error for malformed JSON")
+	}
+}
+
+func TestLintCommand(t *testing.T) {
+	var out bytes.Buffer
+	status := lintCommand([]string{"./example/testing_data"}, &out)
+	if status != 0 {
+		t.Errorf("Got: `%v`; Expected: `0`\n%v", status, out.String())
+	}
+
+	out.Reset()
+	status = lintCommand([]string{"./does-not-exist"}, &out)
+	if status != 1 {
+		t.Errorf("Got: `%v`; Expected: `1`\n%v", status, out.String())
+	}
+
+	out.Reset()
+	status = lintCommand([]string{}, &out)
+	if status != 2 {
+		t.Errorf("Got: `%v`; Expected: `2`", status)
+	}
+}
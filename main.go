@@ -1,35 +1,153 @@
+//go:build !testing
 // +build !testing
 
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
+	"sort"
+	"syscall"
+	"time"
 )
 
 var (
-	proxiedURL = flag.String("url", "", "Fully qualified, absolute URL to proxy (e.g. https://example.com)")
-	dataDir    = flag.String("data", "", "Path to a directory in which to hold the responses for this url")
-	host       = flag.String("host", "localhost:6005", "Host/port on which to bind")
-	cHasher    = flag.String("hasher", "", "Custom hasher program for all requests (e.g. python ./hasher.py)")
-	verbose    = flag.Bool("verbose", false, "Turn on verbose logging")
+	proxiedURL      = flag.String("url", "", "Fully qualified, absolute URL to proxy (e.g. https://example.com)")
+	dataDir         = flag.String("data", "", "Path to a directory in which to hold the responses for this url")
+	forwardProxy    = flag.Bool("forward-proxy", false, "Act as an HTTP proxy (e.g. for HTTP_PROXY) instead of proxying -url, recording each host in its own directory under -data")
+	caDirectory     = flag.String("ca-dir", "", "Directory holding the CA used to intercept HTTPS in -forward-proxy mode, outside -data (default: chameleon in the user's config directory)")
+	routesFile      = flag.String("routes", "", "JSON file of routes sending path prefixes or hosts to other upstreams, each with its own data directory")
+	host            = flag.String("host", "localhost:6005", "Host/port on which to bind")
+	tlsCert         = flag.String("tls-cert", "", "Serve HTTPS (and HTTP/2) with this PEM certificate file; requires -tls-key")
+	tlsKey          = flag.String("tls-key", "", "PEM private key file for -tls-cert")
+	tlsSelfSigned   = flag.Bool("tls-self-signed", false, "Serve HTTPS (and HTTP/2) with a self-signed certificate generated at startup")
+	upstreamConnect = flag.Duration("upstream-connect-timeout", 30*time.Second, "Timeout for connecting to the proxied service, including the TLS handshake (0 for none)")
+	upstreamTimeout = flag.Duration("upstream-response-timeout", 0, "Timeout for the proxied service to send response headers; bodies aren't limited (0 for none)")
+	upstreamCA      = flag.String("upstream-ca", "", "PEM bundle of extra certificate authorities to trust for the proxied service")
+	upstreamCert    = flag.String("upstream-cert", "", "PEM client certificate for proxied services requiring mutual TLS; requires -upstream-key")
+	upstreamKey     = flag.String("upstream-key", "", "PEM private key file for -upstream-cert")
+	upstreamInsec   = flag.Bool("upstream-insecure", false, "Accept any certificate from the proxied service (e.g. a self-signed staging server)")
+	upstreamProxy   = flag.String("upstream-proxy", "", "Send requests to the proxied service through this proxy URL (default: from HTTP_PROXY, HTTPS_PROXY and NO_PROXY)")
+	followRedirects = flag.Bool("follow-redirects", false, "Follow redirects from the proxied service and record the final response, instead of passing redirects on")
+	h2c             = flag.Bool("h2c", true, "Accept unencrypted HTTP/2 (h2c) from clients which start with it, when not serving HTTPS")
+	cHasher         = flag.String("hasher", "", "Custom hasher program for all requests (e.g. python ./hasher.py)")
+	verbose         = flag.Bool("verbose", false, "Turn on verbose logging")
+	strict          = flag.Bool("strict", false, "Refuse to start if the data directory has invalid entries, instead of skipping them")
+	trackUsage      = flag.Bool("track-usage", false, "Save how often each response is served to usage.json on exit, for the prune command")
+	shard           = flag.Bool("shard", false, "Write new content files in nested directories (e.g. ab/cd/abcdef...) instead of a single directory")
+	compression     = flag.String("compression", "none", "Compression for new content files: gzip or none")
+	lazy            = flag.Bool("lazy", false, "Stream response bodies from disk when requested, instead of loading them all into memory")
+	lazyCache       = flag.Int64("lazy-cache-bytes", 0, "With -lazy, keep up to this many bytes of recently requested bodies in memory")
+	maxRecordSize   = flag.Int64("max-record-size", 0, "Largest response body, in bytes, to record; larger responses are proxied without being cached")
+	eventDelayScale = flag.Float64("event-delay-scale", 1, "Scale the delays between replayed server-sent events and WebSocket frames (e.g. 0.5 for twice as fast, 0 for no delays)")
+	forwarded       = flag.Bool("forwarded-headers", true, "Add X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and Via headers to proxied requests")
+	rewriteURLs     = flag.Bool("rewrite-urls", false, "Replace the proxied URL with chameleon's own in Location, Content-Location and Link response headers")
+	rewriteBodies   = flag.Bool("rewrite-bodies", false, "With -rewrite-urls, also replace the proxied URL in text response bodies")
+	publicURL       = flag.String("public-url", "", "URL clients use to reach chameleon, for -rewrite-urls (defaults to the Host of each request)")
+	rewriteCookies  = flag.Bool("rewrite-cookies", false, "Remove the Domain (and, unless chameleon is reached over HTTPS, Secure) of cookies set by the proxied service")
+	latency         = flag.String("latency", "instant", "How long to take to replay cached responses: instant, original, scaled:N, fixed:DURATION or random:MIN-MAX")
+	routeLatency    routeFlag
+	routeFault      routeFlag
+	routeRateLimit  routeFlag
+	watch           = flag.Duration("watch", 0, "Poll the data directory for changes at this interval and reload them (e.g. 2s)")
 )
 
+func init() {
+	flag.Var(&routeLatency, "route-latency", "Latency policy for requests under a path prefix, as PREFIX=POLICY (e.g. /orders=fixed:200ms); may be repeated")
+	flag.Var(&routeFault, "route-fault", "Fault to inject for requests under a path prefix, as PREFIX=FAULT[,FAULT...] where FAULT is status:CODE, reset, truncate:BYTES, drip:BYTES_PER_SECOND, latency:DURATION or probability:P (e.g. /orders=status:503,probability:0.3); may be repeated")
+	flag.Var(&routeRateLimit, "route-rate-limit", "Rate limit for requests under a path prefix, as PREFIX=N/PERIOD[,burst:N][,key:ip|key:header:NAME] where PERIOD is s, m or h (e.g. /api=100/m,key:ip); may be repeated")
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags]\n", os.Args[0])
+	flag.PrintDefaults()
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "\nCommands (see %v COMMAND -help):\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12v%v\n", name, commands[name].Usage)
+	}
+}
+
+// newCacher returns a DiskCacher for dir, configured from the flags, with its responses loaded.
+// Invalid entries are skipped with a warning, unless -strict is set.
+func newCacher(dir string) (*DiskCacher, error) {
+	cacher := NewDiskCacher(dir)
+	cacher.Strict = *strict
+	cacher.Sharded = *shard
+	cacher.Compression = *compression
+	cacher.Lazy = *lazy
+	cacher.LazyCacheSize = *lazyCache
+	if err := cacher.SeedCache(); err != nil {
+		if _, ok := err.(SpecErrors); !ok || *strict {
+			return nil, fmt.Errorf("Unable to load %v:\n%v", dir, err)
+		}
+		fmt.Fprintf(os.Stderr, "Skipping invalid entries in %v:\n%v\n", dir, err)
+	}
+	return cacher, nil
+}
+
+// mustNewCacher returns newCacher(dir), exiting if the responses can't be loaded.
+func mustNewCacher(dir string) *DiskCacher {
+	cacher, err := newCacher(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return cacher
+}
+
+// newHasher returns a hasher running command, or the default hasher if command is empty.
+func newHasher(command string) Hasher {
+	if command != "" {
+		return CmdHasher{Command: command, Commander: DefaultCommander{}}
+	}
+	return DefaultHasher{}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd.Run(os.Args[2:], os.Stdout))
+		}
+	}
+
+	flag.Usage = usage
 	flag.Parse()
-	if *proxiedURL == "" || *dataDir == "" {
+	usesData := *proxiedURL != "" || *forwardProxy
+	if usesData != (*dataDir != "") || (!usesData && *routesFile == "") {
 		flag.Usage()
 		os.Exit(-1)
 	}
+	if (*tlsCert == "") != (*tlsKey == "") || (*tlsCert != "" && *tlsSelfSigned) {
+		fmt.Fprintln(os.Stderr, "Use either -tls-cert with -tls-key, or -tls-self-signed")
+		os.Exit(1)
+	}
+	if *proxiedURL != "" && *forwardProxy {
+		fmt.Fprintln(os.Stderr, "-forward-proxy records each host under -data, so it can't be used with -url")
+		os.Exit(1)
+	}
 
-	serverURL, err := url.Parse(*proxiedURL)
-	if err != nil {
-		log.Fatal(err)
+	var public *url.URL
+	if *publicURL != "" {
+		var err error
+		public, err = url.Parse(*publicURL)
+		if err != nil || public.Scheme == "" || public.Host == "" {
+			fmt.Fprintf(os.Stderr, "Invalid -public-url %q: expected an absolute URL (e.g. http://localhost:6005)\n", *publicURL)
+			os.Exit(1)
+		}
 	}
 
 	if !*verbose {
@@ -38,17 +156,171 @@ func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	log.Printf("Starting proxy for '%v' on %v\n", serverURL.String(), *host)
-	var hasher Hasher
-	if *cHasher != "" {
-		hasher = CmdHasher{Command: *cHasher, Commander: DefaultCommander{}}
-	} else {
-		hasher = DefaultHasher{}
+	if *compression == "none" {
+		*compression = ""
+	}
+	if _, err := compressContent(nil, *compression); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	latencyPolicy, err := ParseLatencyPolicy(*latency)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	latencyRoutes, err := parseLatencyRoutes(routeLatency)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	faults := NewFaultInjector()
+	routeFaults, err := parseFaultRoutes(routeFault)
+	if err == nil {
+		err = faults.SetFaults(routeFaults)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	rateLimits, err := parseRateLimitRoutes(routeRateLimit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	client, err := UpstreamConfig{
+		ConnectTimeout:     *upstreamConnect,
+		ResponseTimeout:    *upstreamTimeout,
+		CAFile:             *upstreamCA,
+		CertFile:           *upstreamCert,
+		KeyFile:            *upstreamKey,
+		InsecureSkipVerify: *upstreamInsec,
+		Proxy:              *upstreamProxy,
+		FollowRedirects:    *followRedirects,
+	}.Client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var routes []UpstreamRoute
+	if *routesFile != "" {
+		routes, err = ReadUpstreamRoutes(*routesFile, *dataDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	options := ProxyOptions{
+		MaxRecordSize:    *maxRecordSize,
+		EventDelayScale:  *eventDelayScale,
+		Latency:          latencyPolicy,
+		RouteLatency:     latencyRoutes,
+		Faults:           faults,
+		RateLimits:       NewRateLimiter(rateLimits),
+		ForwardedHeaders: *forwarded,
+		RewriteURLs:      *rewriteURLs,
+		RewriteBodies:    *rewriteBodies,
+		PublicURL:        public,
+		RewriteCookies:   *rewriteCookies,
+		Client:           client,
 	}
-	cacher := NewDiskCacher(*dataDir)
-	cacher.SeedCache()
 	mux := http.NewServeMux()
-	mux.Handle("/_seed", PreseedHandler(cacher, hasher))
-	mux.Handle("/", CachedProxyHandler(serverURL, cacher, hasher))
-	log.Fatal(http.ListenAndServe(*host, mux))
+	var cachers []*DiskCacher
+	for _, route := range routes {
+		// ReadUpstreamRoutes has checked the URL
+		serverURL, _ := url.Parse(route.URL)
+		command := route.Hasher
+		if command == "" {
+			command = *cHasher
+		}
+		cacher := mustNewCacher(route.Data)
+		handler := CachedProxyHandler(serverURL, cacher, newHasher(command), options)
+		for _, pattern := range route.patterns() {
+			mux.Handle(pattern, handler)
+		}
+		cachers = append(cachers, cacher)
+		log.Printf("Routing '%v%v' to '%v'\n", route.Host, route.Prefix, serverURL.String())
+	}
+	if *proxiedURL != "" {
+		serverURL, err := url.Parse(*proxiedURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cacher := mustNewCacher(*dataDir)
+		hasher := newHasher(*cHasher)
+		mux.Handle("/_seed", PreseedHandler(cacher, hasher))
+		mux.Handle("/_prune", PruneHandler(cacher))
+		mux.Handle("/", CachedProxyHandler(serverURL, cacher, hasher, options))
+		cachers = append(cachers, cacher)
+		log.Printf("Starting proxy for '%v' on %v\n", serverURL.String(), *host)
+	}
+
+	var reloaders Reloaders
+	for _, cacher := range cachers {
+		reloaders = append(reloaders, cacher)
+		if *watch > 0 {
+			go cacher.Watch(*watch, nil)
+		}
+	}
+	var handler http.Handler = mux
+	var forward *ForwardProxy
+	if *forwardProxy {
+		dir, err := caDir(*caDirectory, *dataDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		ca, err := LoadOrCreateCA(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		mux.Handle("/_ca.pem", CAHandler(ca))
+		log.Printf("Intercepting HTTPS with the CA in %v\n", dir)
+		hostCacher := func(dir string) (*DiskCacher, error) {
+			cacher, err := newCacher(dir)
+			if err == nil && *watch > 0 {
+				go cacher.Watch(*watch, nil)
+			}
+			return cacher, err
+		}
+		forward = NewForwardProxy(*dataDir, ca, hostCacher, newHasher(*cHasher), options, mux)
+		handler = forward
+		reloaders = append(reloaders, forward)
+		log.Printf("Starting forward proxy on %v\n", *host)
+	}
+	if *trackUsage {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			status := 0
+			if forward != nil {
+				cachers = append(cachers, forward.Cachers()...)
+			}
+			for _, cacher := range cachers {
+				if err := cacher.SaveUsage(); err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to save usage for %v: %v\n", cacher.dataDir, err)
+					status = 1
+				}
+			}
+			os.Exit(status)
+		}()
+	}
+	mux.Handle("/_reload", ReloadHandler(reloaders))
+	mux.Handle("/_faults", FaultsHandler(faults))
+	useTLS := *tlsCert != "" || *tlsSelfSigned
+	server := &http.Server{Addr: *host, Handler: handler, Protocols: serverProtocols(useTLS, *h2c)}
+	if *tlsSelfSigned {
+		cert, err := selfSignedCertificate(selfSignedHosts(*host))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if useTLS {
+		log.Fatal(server.ListenAndServeTLS(*tlsCert, *tlsKey))
+	}
+	log.Fatal(server.ListenAndServe())
 }
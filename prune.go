@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// PruneOptions selects the entries removed by Prune.
+type PruneOptions struct {
+	// Unused removes entries which haven't been used since Since.
+	// If Since is zero, it defaults to when the cacher was created.
+	Unused bool
+	Since  time.Time
+	// OlderThan removes entries which haven't been used for this long. Zero disables it.
+	OlderThan time.Duration
+	// DryRun reports the entries which would be removed, without removing them.
+	DryRun bool
+}
+
+func (opts PruneOptions) selects(usage *Usage, now time.Time) bool {
+	if opts.Unused && (usage == nil || usage.LastUsed.Before(opts.Since)) {
+		return true
+	}
+	if opts.OlderThan > 0 && (usage == nil || now.Sub(usage.LastUsed) > opts.OlderThan) {
+		return true
+	}
+	return false
+}
+
+// Prune removes the entries selected by opts from spec.json and the cache, along with any content
+// files no remaining entry refers to. Entries without any recorded usage count as never used.
+// It returns the keys of the removed entries.
+func (c *DiskCacher) Prune(opts PruneOptions) ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+
+	if opts.Since.IsZero() {
+		opts.Since = c.started
+	}
+	usage := c.currentUsage().Keys
+	now := time.Now()
+
+	var rawSpecs []json.RawMessage
+	err := json.Unmarshal(c.readSpecContent(), &rawSpecs)
+	if err != nil {
+		return nil, jsonError(c.specPath, c.readSpecContent(), 0, err)
+	}
+
+	var kept []json.RawMessage
+	var removed []string
+	referenced := make(map[string]bool)
+	candidates := make(map[string]bool)
+	for _, raw := range rawSpecs {
+		var spec Spec
+		if json.Unmarshal(raw, &spec) != nil {
+			// Leave entries we can't understand alone
+			kept = append(kept, raw)
+			continue
+		}
+		contentFile := path.Clean(spec.ContentFile)
+		if opts.selects(usage[spec.Key], now) {
+			removed = append(removed, spec.Key)
+			// Content files outside the data directory may belong to something else, so they are left alone
+			if insideDataDir(contentFile) {
+				candidates[contentFile] = true
+			}
+			continue
+		}
+		kept = append(kept, raw)
+		for _, name := range contentLayouts(contentFile) {
+			referenced[name] = true
+		}
+	}
+
+	if opts.DryRun || len(removed) == 0 {
+		return removed, nil
+	}
+
+	err = c.writeRawSpecs(kept)
+	if err != nil {
+		return nil, err
+	}
+
+	for contentFile := range candidates {
+		if referenced[contentFile] {
+			continue
+		}
+		err = c.removeContent(contentFile)
+		if err != nil {
+			return removed, err
+		}
+	}
+	for _, key := range removed {
+		delete(c.cache, key)
+	}
+
+	return removed, nil
+}
+
+func pruneCommand(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	unused := flags.Bool("unused", false, "Remove entries which weren't used during the last run with -track-usage")
+	olderThan := flags.Duration("older-than", 0, "Remove entries which haven't been used for this long (e.g. 720h)")
+	dryRun := flags.Bool("dry-run", false, "List the entries which would be removed, without removing them")
+	flags.Usage = func() {
+		fmt.Fprintln(stdout, "Usage: chameleon prune [-unused] [-older-than DURATION] [-dry-run] DIR")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (!*unused && *olderThan == 0) {
+		flags.Usage()
+		return 2
+	}
+
+	dir := flags.Arg(0)
+	cacher := NewDiskCacher(dir)
+	record, err := cacher.readUsage()
+	if err != nil {
+		fmt.Fprintf(stdout, "%v: no usage recorded, run chameleon with -track-usage first: %v\n", dir, err)
+		return 1
+	}
+
+	removed, err := cacher.Prune(PruneOptions{
+		Unused:    *unused,
+		Since:     record.LastRun.Started,
+		OlderThan: *olderThan,
+		DryRun:    *dryRun,
+	})
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	for _, key := range removed {
+		fmt.Fprintf(stdout, "%v: %v %v\n", dir, verb, key)
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, "%v: error: %v\n", dir, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pruneFileSystem() mapFileSystem {
+	return mapFileSystem{
+		"data/spec.json": []byte(`[
+    {"key": "used", "response": {"status_code": 200, "content": "used"}},
+    {"key": "stale", "response": {"status_code": 200, "content": "stale"}},
+    {"key": "shared", "response": {"status_code": 200, "content": "used"}},
+    {"key": "never", "response": {"status_code": 200, "content": "never"}}
+]`),
+		"data/used":  []byte("USED"),
+		"data/stale": []byte("STALE"),
+		"data/never": []byte("NEVER"),
+		"data/usage.json": []byte(`{
+    "last_run": {"started": "2015-01-10T00:00:00Z", "stopped": "2015-01-10T01:00:00Z"},
+    "keys": {
+        "used": {"hits": 2, "last_used": "2015-01-10T00:30:00Z"},
+        "stale": {"hits": 1, "last_used": "2015-01-01T00:00:00Z"}
+    }
+}`),
+	}
+}
+
+func TestDiskCacherPruneUnused(t *testing.T) {
+	fs := pruneFileSystem()
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+	_ = cacher.SeedCache()
+
+	since, _ := time.Parse(time.RFC3339, "2015-01-10T00:00:00Z")
+	removed, err := cacher.Prune(PruneOptions{Unused: true, Since: since})
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if strings.Join(removed, ",") != "stale,shared,never" {
+		t.Errorf("Got: `%v`; Expected: `stale,shared,never`", removed)
+	}
+
+	if _, ok := fs["data/used"]; !ok {
+		t.Errorf("Content file still used by an entry was removed")
+	}
+	if _, ok := fs["data/stale"]; ok {
+		t.Errorf("Content file of a removed entry was kept")
+	}
+	specs, _, _ := parseSpecs("spec.json", fs["data/spec.json"])
+	if len(specs) != 1 || specs[0].Key != "used" {
+		t.Errorf("Got: `%v`; Expected only `used` to be kept", specs)
+	}
+	if cacher.Get("stale") != nil {
+		t.Errorf("Removed entry is still cached")
+	}
+}
+
+func TestDiskCacherPruneOlderThan(t *testing.T) {
+	fs := pruneFileSystem()
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+	_ = cacher.SeedCache()
+	cacher.Get("stale")
+
+	removed, err := cacher.Prune(PruneOptions{OlderThan: time.Hour, DryRun: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if strings.Join(removed, ",") != "used,shared,never" {
+		t.Errorf("Got: `%v`; Expected: `used,shared,never`", removed)
+	}
+	if _, ok := fs["data/used"]; !ok {
+		t.Errorf("Content file was removed during a dry run")
+	}
+}
+
+func TestDiskCacherPruneKeepsFilesOutsideDataDir(t *testing.T) {
+	fs := mapFileSystem{
+		"data/spec.json": []byte(`[
+    {"key": "shared", "response": {"status_code": 200, "content": "../shared/body.json"}}
+]`),
+		"shared/body.json": []byte("SHARED"),
+	}
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+
+	removed, err := cacher.Prune(PruneOptions{Unused: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if strings.Join(removed, ",") != "shared" {
+		t.Errorf("Got: `%v`; Expected: `shared`", removed)
+	}
+	if _, ok := fs["shared/body.json"]; !ok {
+		t.Errorf("Content file outside the data directory was removed")
+	}
+	if err := cacher.removeFile("../shared/body.json"); err == nil {
+		t.Errorf("Got: `%v`; Expected an error removing a file outside the data directory", err)
+	}
+}
+
+func TestPruneCommand(t *testing.T) {
+	var out bytes.Buffer
+	status := pruneCommand([]string{"-unused", "./does-not-exist"}, &out)
+	if status != 1 {
+		t.Errorf("Got: `%v`; Expected: `1`", status)
+	}
+	if !strings.Contains(out.String(), "-track-usage") {
+		t.Errorf("Got: `%v`; Expected a hint to use -track-usage", out.String())
+	}
+
+	out.Reset()
+	status = pruneCommand([]string{"./does-not-exist"}, &out)
+	if status != 2 {
+		t.Errorf("Got: `%v`; Expected: `2`", status)
+	}
+}
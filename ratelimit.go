@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the rate of requests whose path starts with Prefix, using a token bucket.
+type RateLimit struct {
+	Prefix string
+	// Rate is the number of requests allowed per second, on average
+	Rate float64
+	// Burst is the number of requests allowed at once
+	Burst int
+	// Key decides which requests share a bucket: "" for all of them, "ip" for each client address,
+	// or "header:NAME" for each value of a request header (e.g. header:X-Api-Key)
+	Key string
+}
+
+var ratePeriods = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+// ParseRateLimit parses a rate limit for requests under prefix, as N/PERIOD (where PERIOD is s, m or h)
+// optionally followed by burst:N and key:ip or key:header:NAME (e.g. 100/m,burst:10,key:ip).
+// The burst defaults to N.
+func ParseRateLimit(prefix, s string) (RateLimit, error) {
+	limit := RateLimit{Prefix: prefix}
+	items := strings.Split(s, ",")
+
+	rate := strings.SplitN(items[0], "/", 2)
+	count, err := strconv.Atoi(rate[0])
+	if err != nil || count < 1 || len(rate) != 2 || ratePeriods[rate[1]] == 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: expected N/s, N/m or N/h", s)
+	}
+	limit.Rate = float64(count) / ratePeriods[rate[1]].Seconds()
+	limit.Burst = count
+
+	for _, item := range items[1:] {
+		switch {
+		case strings.HasPrefix(item, "burst:"):
+			limit.Burst, err = strconv.Atoi(strings.TrimPrefix(item, "burst:"))
+			if err == nil && limit.Burst < 1 {
+				err = fmt.Errorf("burst must be at least 1")
+			}
+		case item == "key:ip" || (strings.HasPrefix(item, "key:header:") && len(item) > len("key:header:")):
+			limit.Key = strings.TrimPrefix(item, "key:")
+		default:
+			err = fmt.Errorf("unknown option %q", item)
+		}
+		if err != nil {
+			return RateLimit{}, fmt.Errorf("invalid rate limit %q: %v", s, err)
+		}
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return RateLimit{}, fmt.Errorf("prefix %q must start with /", prefix)
+	}
+	return limit, nil
+}
+
+// clientKey returns the key identifying the bucket which r is taken from.
+func (l RateLimit) clientKey(r *http.Request) string {
+	switch {
+	case l.Key == "ip":
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	case strings.HasPrefix(l.Key, "header:"):
+		return r.Header.Get(strings.TrimPrefix(l.Key, "header:"))
+	}
+	return ""
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the rate of requests to each route.
+type RateLimiter struct {
+	limits  []RateLimit
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+	// now returns the current time, and is replaced in tests
+	now func() time.Time
+}
+
+// NewRateLimiter returns a RateLimiter for limits.
+func NewRateLimiter(limits []RateLimit) *RateLimiter {
+	return &RateLimiter{limits: limits, buckets: make(map[string]*tokenBucket), now: time.Now}
+}
+
+// limit checks whether r is within its route's rate limit, and sets the X-RateLimit-* headers on w.
+// If it isn't, a 429 response is sent and false is returned.
+func (l *RateLimiter) limit(w http.ResponseWriter, r *http.Request) bool {
+	if l == nil {
+		return true
+	}
+	prefixes := make([]string, len(l.limits))
+	for i, limit := range l.limits {
+		prefixes[i] = limit.Prefix
+	}
+	i := longestPrefix(r.URL.Path, prefixes)
+	if i < 0 {
+		return true
+	}
+	limit := l.limits[i]
+
+	l.mutex.Lock()
+	now := l.now()
+	key := limit.Prefix + "\x00" + limit.clientKey(r)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	tokens := bucket.tokens
+	l.mutex.Unlock()
+
+	// Seconds until the bucket is full again
+	reset := math.Ceil((float64(limit.Burst) - tokens) / limit.Rate)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(tokens)))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(reset)))
+	if allowed {
+		return true
+	}
+
+	retryAfter := math.Max(1, math.Ceil((1-tokens)/limit.Rate))
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+	w.WriteHeader(429)
+	fmt.Fprintf(w, "Rate limit exceeded for %v", limit.Prefix)
+	return false
+}
+
+// parseRateLimitRoutes parses the rate limit for each route given with -route-rate-limit.
+func parseRateLimitRoutes(routes routeFlag) ([]RateLimit, error) {
+	limits := make([]RateLimit, len(routes))
+	for i, route := range routes {
+		limit, err := ParseRateLimit(route.Prefix, route.Value)
+		if err != nil {
+			return nil, err
+		}
+		limits[i] = limit
+	}
+	return limits, nil
+}
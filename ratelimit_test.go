@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := ParseRateLimit("/api", "120/m,burst:5,key:header:X-Api-Key")
+	if err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+	expected := RateLimit{Prefix: "/api", Rate: 2, Burst: 5, Key: "header:X-Api-Key"}
+	if limit != expected {
+		t.Errorf("Got: `%+v`; Expected: `%+v`", limit, expected)
+	}
+
+	limit, err = ParseRateLimit("/", "10/s")
+	expected = RateLimit{Prefix: "/", Rate: 10, Burst: 10}
+	if err != nil || limit != expected {
+		t.Errorf("Got: `%+v`, `%v`; Expected: `%+v`", limit, err, expected)
+	}
+
+	for _, s := range []string{"", "10", "10/d", "0/s", "x/s", "10/s,burst:0", "10/s,key:cookie", "10/s,key:header:"} {
+		if _, err := ParseRateLimit("/", s); err == nil {
+			t.Errorf("Expected an error for `%v`", s)
+		}
+	}
+	if _, err := ParseRateLimit("api", "10/s"); err == nil {
+		t.Errorf("Expected an error for a prefix without a leading slash")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewRateLimiter([]RateLimit{
+		{Prefix: "/api", Rate: 1, Burst: 2},
+		{Prefix: "/keyed", Rate: 1, Burst: 1, Key: "header:X-Api-Key"},
+	})
+	limiter.now = func() time.Time { return now }
+
+	request := func(path, key string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("X-Api-Key", key)
+		w := httptest.NewRecorder()
+		if limiter.limit(w, req) {
+			w.WriteHeader(200)
+		}
+		return w
+	}
+
+	for i, expected := range []int{200, 200, 429} {
+		w := request("/api/orders", "")
+		if w.Code != expected {
+			t.Errorf("Got: `%v`; Expected: `%v` for request %v", w.Code, expected, i)
+		}
+	}
+	w := request("/api/orders", "")
+	if w.Header().Get("Retry-After") != "1" || w.Header().Get("X-RateLimit-Remaining") != "0" ||
+		w.Header().Get("X-RateLimit-Limit") != "2" || w.Header().Get("X-RateLimit-Reset") != "2" {
+		t.Errorf("Got: `%v`; Expected rate limit headers", w.Header())
+	}
+
+	now = now.Add(time.Second)
+	if w := request("/api/orders", ""); w.Code != 200 {
+		t.Errorf("Got: `%v`; Expected: `200` once a token was added", w.Code)
+	}
+
+	if w := request("/other", ""); w.Code != 200 || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("Got: `%v`; Expected unlimited requests outside of the routes", w.Code)
+	}
+
+	for key, expected := range map[string]int{"a": 200, "b": 200} {
+		if w := request("/keyed", key); w.Code != expected {
+			t.Errorf("Got: `%v`; Expected: `%v` for key `%v`", w.Code, expected, key)
+		}
+	}
+	if w := request("/keyed", "a"); w.Code != 429 {
+		t.Errorf("Got: `%v`; Expected: `429`", w.Code)
+	}
+}
+
+func TestCachedProxyHandlerRateLimits(t *testing.T) {
+	serverURL, _ := url.Parse("http://example.com")
+	cache := mockCacher{data: map[string]*CachedResponse{"cached": {StatusCode: 200, Body: []byte("cached")}}}
+	limiter := NewRateLimiter([]RateLimit{{Prefix: "/", Rate: 0.001, Burst: 1}})
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{RateLimits: limiter})
+
+	for _, expected := range []int{200, 429} {
+		req, _ := http.NewRequest("GET", "/foo", nil)
+		req.Header.Set("chameleon-request-hash", "cached")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Got: `%v`; Expected: `%v`", w.Code, expected)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteHeaderNames are the response headers which may hold URLs of the proxied service.
+var rewriteHeaderNames = []string{"Location", "Content-Location", "Link"}
+
+// urlRewriter replaces the base URL of the proxied service with chameleon's own in responses,
+// so clients following links keep going through chameleon.
+type urlRewriter struct {
+	from   []byte
+	to     []byte
+	bodies bool
+}
+
+// newURLRewriter returns a urlRewriter for a request, or nil if URLs shouldn't be rewritten.
+// r must not have been changed to point at the proxied service yet.
+func newURLRewriter(serverURL *url.URL, r *http.Request, options ProxyOptions) *urlRewriter {
+	if !options.RewriteURLs {
+		return nil
+	}
+
+	public := options.PublicURL
+	if public == nil {
+		public = &url.URL{Scheme: "http", Host: r.Host}
+		if r.TLS != nil {
+			public.Scheme = "https"
+		}
+	}
+	return &urlRewriter{
+		from:   []byte(serverURL.Scheme + "://" + serverURL.Host),
+		to:     []byte(public.Scheme + "://" + public.Host),
+		bodies: options.RewriteBodies,
+	}
+}
+
+// isHostByte reports whether b may continue a host name (or port), in which case a match ending before it
+// is a different host, e.g. api.example.com.evil or api.example.com:8443.
+func isHostByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '.' || b == '-' || b == ':'
+}
+
+// replace rewrites the URLs in buf. Unless final is set, the end of buf which may be the start of a URL
+// is returned in rest, to be rewritten along with whatever follows it.
+func (u *urlRewriter) replace(buf []byte, final bool) (out, rest []byte) {
+	for {
+		i := bytes.Index(buf, u.from)
+		if i < 0 {
+			break
+		}
+		end := i + len(u.from)
+		if end == len(buf) && !final {
+			return append(out, buf[:i]...), buf[i:]
+		}
+		out = append(out, buf[:i]...)
+		if end == len(buf) || !isHostByte(buf[end]) {
+			out = append(out, u.to...)
+		} else {
+			out = append(out, u.from...)
+		}
+		buf = buf[end:]
+	}
+	if final {
+		return append(out, buf...), nil
+	}
+
+	// Hold back a partial match at the end
+	keep := len(u.from) - 1
+	if keep > len(buf) {
+		keep = len(buf)
+	}
+	for ; keep > 0; keep-- {
+		if bytes.HasPrefix(u.from, buf[len(buf)-keep:]) {
+			break
+		}
+	}
+	return append(out, buf[:len(buf)-keep]...), buf[len(buf)-keep:]
+}
+
+// rewriteHeaders rewrites the URLs in the Location, Content-Location and Link headers.
+func (u *urlRewriter) rewriteHeaders(header http.Header) {
+	for _, name := range rewriteHeaderNames {
+		for i, value := range header[name] {
+			rewritten, _ := u.replace([]byte(value), true)
+			header[name][i] = string(rewritten)
+		}
+	}
+}
+
+// rewritesBody reports whether the body of a response with header should be rewritten:
+// body rewriting must be enabled, and the body must be unencoded text.
+func (u *urlRewriter) rewritesBody(header http.Header) bool {
+	if u == nil || !u.bodies || header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "/json") || strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "/xml") || strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/javascript"
+}
+
+// rewritingWriter rewrites the URLs in a response body as it is written.
+type rewritingWriter struct {
+	http.ResponseWriter
+	rewriter *urlRewriter
+	pending  []byte
+}
+
+func (rw *rewritingWriter) Write(p []byte) (int, error) {
+	out, rest := rw.rewriter.replace(append(rw.pending, p...), false)
+	rw.pending = append([]byte{}, rest...)
+	if _, err := rw.ResponseWriter.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (rw *rewritingWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes anything held back waiting for the rest of a URL.
+func (rw *rewritingWriter) Close() error {
+	out, _ := rw.rewriter.replace(rw.pending, true)
+	rw.pending = nil
+	_, err := rw.ResponseWriter.Write(out)
+	return err
+}
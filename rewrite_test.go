@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testRewriter(bodies bool) *urlRewriter {
+	serverURL, _ := url.Parse("https://api.example.com")
+	req, _ := http.NewRequest("GET", "/orders", nil)
+	req.Host = "localhost:6005"
+	return newURLRewriter(serverURL, req, ProxyOptions{RewriteURLs: true, RewriteBodies: bodies})
+}
+
+func TestURLRewriterReplace(t *testing.T) {
+	rewriter := testRewriter(true)
+	tests := map[string]string{
+		"https://api.example.com/orders/5":        "http://localhost:6005/orders/5",
+		"https://api.example.com":                 "http://localhost:6005",
+		`{"a": "https://api.example.com?page=2"}`: `{"a": "http://localhost:6005?page=2"}`,
+		"https://api.example.com.evil.com/orders": "https://api.example.com.evil.com/orders",
+		"https://api.example.com:8443/orders":     "https://api.example.com:8443/orders",
+		"http://api.example.com/orders":           "http://api.example.com/orders",
+	}
+	for input, expected := range tests {
+		if actual, _ := rewriter.replace([]byte(input), true); string(actual) != expected {
+			t.Errorf("Got: `%v`; Expected: `%v`", string(actual), expected)
+		}
+	}
+
+	// URLs split across writes are still rewritten
+	w := httptest.NewRecorder()
+	writer := &rewritingWriter{ResponseWriter: w, rewriter: rewriter}
+	for _, chunk := range []string{"see https://api.exa", "mple.com", "/orders\n\nand https://api.example.com"} {
+		_, _ = writer.Write([]byte(chunk))
+	}
+	if w.Body.String() != "see http://localhost:6005/orders\n\nand " {
+		t.Errorf("Got: `%v`; Expected the partial URL to be held back", w.Body.String())
+	}
+	_ = writer.Close()
+	if w.Body.String() != "see http://localhost:6005/orders\n\nand http://localhost:6005" {
+		t.Errorf("Got: `%v`; Expected every URL to be rewritten", w.Body.String())
+	}
+}
+
+func TestURLRewriterPublicURL(t *testing.T) {
+	serverURL, _ := url.Parse("https://api.example.com")
+	public, _ := url.Parse("https://chameleon.internal")
+	req, _ := http.NewRequest("GET", "/", nil)
+	rewriter := newURLRewriter(serverURL, req, ProxyOptions{RewriteURLs: true, PublicURL: public})
+	if actual, _ := rewriter.replace([]byte("https://api.example.com/a"), true); string(actual) != "https://chameleon.internal/a" {
+		t.Errorf("Got: `%v`; Expected: `https://chameleon.internal/a`", string(actual))
+	}
+	if newURLRewriter(serverURL, req, ProxyOptions{}) != nil {
+		t.Errorf("Expected no rewriter unless RewriteURLs is set")
+	}
+}
+
+func TestURLRewriterHeaders(t *testing.T) {
+	header := http.Header{
+		"Location": {"https://api.example.com/orders/5"},
+		"Link":     {`<https://api.example.com/orders?page=2>; rel="next"`},
+		"X-Other":  {"https://api.example.com/orders/5"},
+	}
+	testRewriter(false).rewriteHeaders(header)
+	if header.Get("Location") != "http://localhost:6005/orders/5" {
+		t.Errorf("Got: `%v`; Expected: `http://localhost:6005/orders/5`", header.Get("Location"))
+	}
+	if header.Get("Link") != `<http://localhost:6005/orders?page=2>; rel="next"` {
+		t.Errorf("Got: `%v`; Expected the Link header to be rewritten", header.Get("Link"))
+	}
+	if header.Get("X-Other") != "https://api.example.com/orders/5" {
+		t.Errorf("Got: `%v`; Expected other headers to be left alone", header.Get("X-Other"))
+	}
+}
+
+func TestURLRewriterRewritesBody(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"application/json":         true,
+		"application/hal+json":     true,
+		"text/html; charset=utf-8": true,
+		"application/atom+xml":     true,
+		"image/png":                false,
+		"application/octet-stream": false,
+	} {
+		header := http.Header{"Content-Type": {contentType}}
+		if actual := testRewriter(true).rewritesBody(header); actual != expected {
+			t.Errorf("Got: `%v`; Expected: `%v` for `%v`", actual, expected, contentType)
+		}
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if testRewriter(false).rewritesBody(header) {
+		t.Errorf("Expected bodies not to be rewritten unless RewriteBodies is set")
+	}
+	header.Set("Content-Encoding", "br")
+	if testRewriter(true).rewritesBody(header) {
+		t.Errorf("Expected encoded bodies not to be rewritten")
+	}
+}
+
+func TestCachedProxyHandlerRewritesURLs(t *testing.T) {
+	var upstreamURL string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.Header().Set("Location", upstreamURL+"/orders/5")
+		w.WriteHeader(201)
+		fmt.Fprintf(w, `{"_links": {"self": {"href": "%v/orders/5"}}}`, upstreamURL)
+	}))
+	defer upstream.Close()
+	upstreamURL = upstream.URL
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := mockCacher{data: make(map[string]*CachedResponse)}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{RewriteURLs: true, RewriteBodies: true})
+
+	var hash string
+	for _, expected := range []string{cacheMiss, cacheHit} {
+		req, _ := http.NewRequest("POST", "/orders", nil)
+		req.Host = "localhost:6005"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		hash = w.Header().Get("chameleon-request-hash")
+
+		if w.Header().Get("chameleon-cache") != expected {
+			t.Errorf("Got: `%v`; Expected: `%v`", w.Header().Get("chameleon-cache"), expected)
+		}
+		if w.Header().Get("Location") != "http://localhost:6005/orders/5" {
+			t.Errorf("Got: `%v`; Expected: `http://localhost:6005/orders/5`", w.Header().Get("Location"))
+		}
+		if w.Body.String() != `{"_links": {"self": {"href": "http://localhost:6005/orders/5"}}}` {
+			t.Errorf("Got: `%v`; Expected the link to be rewritten", w.Body.String())
+		}
+	}
+
+	response := cache.data[hash]
+	if response.Headers["Location"] != upstream.URL+"/orders/5" {
+		t.Errorf("Got: `%v`; Expected the original Location to be recorded", response.Headers["Location"])
+	}
+}
+
+func TestCachedProxyHandlerRewriteBodiesReplaysEncoding(t *testing.T) {
+	var upstreamURL string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"href": "%v/orders/5"}`, upstreamURL)
+	}))
+	defer upstream.Close()
+	upstreamURL = upstream.URL
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := mockCacher{data: make(map[string]*CachedResponse)}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{RewriteURLs: true, RewriteBodies: true})
+
+	for _, expected := range []string{cacheMiss, cacheHit} {
+		req, _ := http.NewRequest("GET", "/orders/5", nil)
+		req.Host = "localhost:6005"
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Header().Get("chameleon-cache") != expected {
+			t.Errorf("Got: `%v`; Expected: `%v`", w.Header().Get("chameleon-cache"), expected)
+		}
+		if expected == cacheMiss {
+			// As if it was recorded without -rewrite-bodies
+			cache.data[w.Header().Get("chameleon-request-hash")].Encoding = "gzip"
+			continue
+		}
+		if w.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Got: `%v`; Expected: `gzip`", w.Header().Get("Content-Encoding"))
+		}
+		body, err := decompressContent(w.Body.Bytes(), gzipCompression)
+		if err != nil || string(body) != `{"href": "http://localhost:6005/orders/5"}` {
+			t.Errorf("Got: `%v`, `%v`; Expected the link to be rewritten", string(body), err)
+		}
+	}
+}
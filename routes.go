@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// routeValue is a setting which applies to requests whose path starts with Prefix.
+type routeValue struct {
+	Prefix string
+	Value  string
+}
+
+// routeFlag is a flag which may be repeated to give a setting for each route, as PREFIX=VALUE.
+type routeFlag []routeValue
+
+func (f *routeFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	values := make([]string, len(*f))
+	for i, route := range *f {
+		values[i] = route.Prefix + "=" + route.Value
+	}
+	return strings.Join(values, ",")
+}
+
+func (f *routeFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 0 || !strings.HasPrefix(s, "/") {
+		return fmt.Errorf("expected PREFIX=VALUE with a path prefix (e.g. /orders=...), got %q", s)
+	}
+	*f = append(*f, routeValue{Prefix: s[:i], Value: s[i+1:]})
+	return nil
+}
+
+// longestPrefix returns the index of the longest of prefixes which path starts with, or -1 if none match.
+func longestPrefix(path string, prefixes []string) int {
+	match := -1
+	for i, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) && (match < 0 || len(prefix) > len(prefixes[match])) {
+			match = i
+		}
+	}
+	return match
+}
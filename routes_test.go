@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRouteFlag(t *testing.T) {
+	var routes routeFlag
+	for _, s := range []string{"/orders=fixed:200ms", "/=a=b"} {
+		if err := routes.Set(s); err != nil {
+			t.Errorf("Unexpected error: `%v`", err)
+		}
+	}
+	if routes.String() != "/orders=fixed:200ms,/=a=b" {
+		t.Errorf("Got: `%v`; Expected: `/orders=fixed:200ms,/=a=b`", routes.String())
+	}
+	for _, s := range []string{"orders=instant", "/orders"} {
+		if err := routes.Set(s); err == nil {
+			t.Errorf("Expected an error for `%v`", s)
+		}
+	}
+}
+
+func TestLongestPrefix(t *testing.T) {
+	prefixes := []string{"/", "/orders/", "/orders"}
+	for path, expected := range map[string]int{
+		"/orders/5": 1,
+		"/orders":   2,
+		"/users":    0,
+	} {
+		if actual := longestPrefix(path, prefixes); actual != expected {
+			t.Errorf("Got: `%v`; Expected: `%v` for `%v`", actual, expected, path)
+		}
+	}
+	if actual := longestPrefix("/users", []string{"/orders"}); actual != -1 {
+		t.Errorf("Got: `%v`; Expected: `-1`", actual)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+)
+
+// shardedName returns the path of a content file in the sharded layout, e.g. `ab/cd/abcdef...`.
+// Names too short to shard are returned unchanged.
+func shardedName(name string) string {
+	if len(name) < 4 {
+		return name
+	}
+	return path.Join(name[0:2], name[2:4], name)
+}
+
+// layoutName returns the path of a flat content file name in the given layout.
+func layoutName(name string, sharded bool) string {
+	if sharded {
+		return shardedName(name)
+	}
+	return name
+}
+
+// contentLayouts returns the paths a content file may be found at: the path given in spec.json,
+// then its flat and sharded equivalents. Paths which are in neither layout have no equivalents.
+func contentLayouts(name string) []string {
+	name = path.Clean(name)
+	base := path.Base(name)
+	if name != base && name != shardedName(base) {
+		return []string{name}
+	}
+
+	layouts := []string{name}
+	for _, alt := range []string{base, shardedName(base)} {
+		if alt != name {
+			layouts = append(layouts, alt)
+		}
+	}
+	return layouts
+}
+
+// referenceSpecs returns every path the content files of specs may be found at. Nil specs are ignored.
+func referenceSpecs(specs []*Spec) map[string]bool {
+	referenced := make(map[string]bool)
+	for _, spec := range specs {
+		if spec == nil {
+			continue
+		}
+		for _, name := range contentLayouts(spec.ContentFile) {
+			referenced[name] = true
+		}
+	}
+	return referenced
+}
+
+// readContent reads a content file from whichever layout it is stored in.
+func (c *DiskCacher) readContent(name string) ([]byte, error) {
+	var firstErr error
+	for _, layout := range contentLayouts(name) {
+		body, err := c.FileSystem.ReadFile(path.Join(c.dataDir, layout))
+		if err == nil {
+			return body, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// removeFile removes a file from the data directory, along with any directories it leaves empty.
+// Files outside the data directory are never removed.
+func (c *DiskCacher) removeFile(name string) error {
+	if !insideDataDir(name) {
+		return fmt.Errorf("%q is outside the data directory", name)
+	}
+	p := path.Join(c.dataDir, name)
+	err := c.own.track(p, func() error {
+		return c.FileSystem.Remove(p)
+	})
+	if err != nil {
+		return err
+	}
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		// Directories which aren't empty can't be removed, which is fine
+		if c.FileSystem.Remove(path.Join(c.dataDir, dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// removeContent removes a content file from whichever layout it is stored in.
+func (c *DiskCacher) removeContent(name string) error {
+	var firstErr error
+	for _, layout := range contentLayouts(name) {
+		err := c.removeFile(layout)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Migrate moves every content file in the data directory to the flat or sharded layout
+// and updates spec.json to match. It returns the number of content files moved.
+// Content files in neither layout (e.g. `bodies/foo`) are left where they are.
+func (c *DiskCacher) Migrate(sharded bool) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+
+	var rawSpecs []json.RawMessage
+	content := c.readSpecContent()
+	err := json.Unmarshal(content, &rawSpecs)
+	if err != nil {
+		return 0, jsonError(c.specPath, content, 0, err)
+	}
+
+	moved := make(map[string]bool)
+	for i, raw := range rawSpecs {
+		var spec Spec
+		if json.Unmarshal(raw, &spec) != nil {
+			continue
+		}
+		name := path.Clean(spec.ContentFile)
+		base := path.Base(name)
+		if name != base && name != shardedName(base) {
+			continue
+		}
+		target := layoutName(base, sharded)
+		if target == name {
+			continue
+		}
+
+		if _, ok := moved[name]; !ok {
+			body, err := c.readContent(name)
+			if err != nil {
+				return 0, err
+			}
+			err = c.writeFile(target, body)
+			if err != nil {
+				return 0, err
+			}
+			moved[name] = true
+		}
+
+		spec.ContentFile = target
+		rawSpecs[i], err = json.Marshal(spec)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(moved) == 0 {
+		return 0, nil
+	}
+
+	err = c.writeRawSpecs(rawSpecs)
+	if err != nil {
+		return 0, err
+	}
+
+	for name := range moved {
+		// The content may have already been in the new layout, so there is nothing to remove
+		_ = c.removeFile(name)
+	}
+	return len(moved), nil
+}
+
+func migrateCommand(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	layout := flags.String("layout", "sharded", "Layout to move content files to: sharded or flat")
+	flags.Usage = func() {
+		fmt.Fprintln(stdout, "Usage: chameleon migrate [-layout sharded|flat] DIR...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || (*layout != "sharded" && *layout != "flat") {
+		flags.Usage()
+		return 2
+	}
+
+	status := 0
+	for _, dir := range flags.Args() {
+		moved, err := NewDiskCacher(dir).Migrate(*layout == "sharded")
+		if err != nil {
+			fmt.Fprintf(stdout, "%v: error: %v\n", dir, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "%v: moved %d content files\n", dir, moved)
+	}
+	return status
+}
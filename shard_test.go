@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestShardedName(t *testing.T) {
+	if name := shardedName("abcdef"); name != "ab/cd/abcdef" {
+		t.Errorf("Got: `%v`; Expected: `ab/cd/abcdef`", name)
+	}
+	if name := shardedName("abc"); name != "abc" {
+		t.Errorf("Got: `%v`; Expected: `abc`", name)
+	}
+}
+
+func TestContentLayouts(t *testing.T) {
+	cases := map[string][]string{
+		"abcdef":         {"abcdef", "ab/cd/abcdef"},
+		"./ab/cd/abcdef": {"ab/cd/abcdef", "abcdef"},
+		"bodies/abcdef":  {"bodies/abcdef"},
+	}
+	for name, expected := range cases {
+		if layouts := contentLayouts(name); !reflect.DeepEqual(layouts, expected) {
+			t.Errorf("Got: `%v`; Expected: `%v`", layouts, expected)
+		}
+	}
+}
+
+func TestDiskCacherReadsBothLayouts(t *testing.T) {
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = mapFileSystem{
+		"data/spec.json": []byte(`[
+    {"key": "flat", "response": {"status_code": 200, "content": "flatfile"}},
+    {"key": "sharded", "response": {"status_code": 200, "content": "sh/ar/shardedfile"}},
+    {"key": "moved", "response": {"status_code": 200, "content": "movedfile"}}
+]`),
+		"data/flatfile":          []byte("FLAT"),
+		"data/sh/ar/shardedfile": []byte("SHARDED"),
+		"data/mo/ve/movedfile":   []byte("MOVED"),
+	}
+
+	err := cacher.SeedCache()
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	for key, body := range map[string]string{"flat": "FLAT", "sharded": "SHARDED", "moved": "MOVED"} {
+		if response := cacher.Get(key); response == nil || string(response.Body) != body {
+			t.Errorf("Got: `%v`; Expected: `%v`", response, body)
+		}
+	}
+}
+
+func TestDiskCacherPutSharded(t *testing.T) {
+	fs := mapFileSystem{}
+	cacher := NewDiskCacher("data")
+	cacher.FileSystem = fs
+	cacher.Sharded = true
+
+	recorder := httptest.NewRecorder()
+	recorder.Code = 200
+	_, _ = recorder.WriteString("BODY")
+	_ = cacher.Put("key", recorder)
+
+	name := shardedName(contentName([]byte("BODY")))
+	if string(fs["data/"+name]) != "BODY" {
+		t.Errorf("Content file `%v` was not written", name)
+	}
+}
+
+func TestDiskCacherMigrate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, "spec.json"), []byte(`[
+    {"key": "a", "response": {"status_code": 200, "content": "abcdef"}},
+    {"key": "b", "response": {"status_code": 200, "content": "abcdef"}},
+    {"key": "c", "response": {"status_code": 200, "content": "bodies/custom"}}
+]`), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "abcdef"), []byte("CONTENT"), 0644)
+	_ = os.Mkdir(filepath.Join(dir, "bodies"), 0755)
+	_ = ioutil.WriteFile(filepath.Join(dir, "bodies", "custom"), []byte("CUSTOM"), 0644)
+
+	cacher := NewDiskCacher(dir)
+	moved, err := cacher.Migrate(true)
+	if err != nil || moved != 1 {
+		t.Fatalf("Got: `%v`, `%v`; Expected: `1` file moved", moved, err)
+	}
+	files, _ := cacher.ListFiles(dir)
+	expected := []string{"ab/cd/abcdef", "bodies/custom", "spec.json"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Got: `%v`; Expected: `%v`", files, expected)
+	}
+
+	moved, err = cacher.Migrate(false)
+	if err != nil || moved != 1 {
+		t.Fatalf("Got: `%v`, `%v`; Expected: `1` file moved", moved, err)
+	}
+	files, _ = cacher.ListFiles(dir)
+	expected = []string{"abcdef", "bodies/custom", "spec.json"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Got: `%v`; Expected: `%v`", files, expected)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ab")); !os.IsNotExist(err) {
+		t.Errorf("Empty shard directories were not removed")
+	}
+
+	if err := cacher.SeedCache(); err != nil || len(cacher.cache) != 3 {
+		t.Errorf("Got: `%v` entries, `%v`; Expected all entries to load", len(cacher.cache), err)
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	var out bytes.Buffer
+	status := migrateCommand([]string{"-layout", "nested", "./data"}, &out)
+	if status != 2 {
+		t.Errorf("Got: `%v`; Expected: `2`", status)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// EventTiming records when an event in a text/event-stream response was sent by upstream.
+type EventTiming struct {
+	// End is the offset of the end of the event in the body
+	End int64 `json:"end"`
+	// Delay is the number of milliseconds between the start of the response and the event
+	Delay int64 `json:"delay_ms"`
+}
+
+func isEventStream(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// eventScanner finds the ends of events (blank lines) in a text/event-stream body as it is written.
+type eventScanner struct {
+	start   time.Time
+	offset  int64
+	lineLen int
+	events  []EventTiming
+}
+
+func newEventScanner() *eventScanner {
+	return &eventScanner{start: time.Now(), events: []EventTiming{}}
+}
+
+func (s *eventScanner) Write(p []byte) (int, error) {
+	for _, b := range p {
+		s.offset++
+		switch b {
+		case '\r':
+			// Part of a CRLF line ending
+		case '\n':
+			if s.lineLen == 0 {
+				delay := time.Since(s.start) / time.Millisecond
+				s.events = append(s.events, EventTiming{End: s.offset, Delay: int64(delay)})
+			}
+			s.lineLen = 0
+		default:
+			s.lineLen++
+		}
+	}
+	return len(p), nil
+}
+
+// end returns the offset of the end of the last complete event.
+func (s *eventScanner) end() int64 {
+	if len(s.events) == 0 {
+		return 0
+	}
+	return s.events[len(s.events)-1].End
+}
+
+// replayEvents writes body to w one event at a time, flushing after each event and waiting between them
+// as upstream did, scaled by scale. A scale of zero replays every event immediately.
+func replayEvents(w http.ResponseWriter, body io.Reader, events []EventTiming, scale float64) error {
+	flusher, _ := w.(http.Flusher)
+	start := time.Now()
+
+	var written int64
+	for _, event := range events {
+		delay := time.Duration(float64(event.Delay)*scale) * time.Millisecond
+		time.Sleep(delay - time.Since(start))
+
+		n, err := io.CopyN(w, body, event.End-written)
+		written += n
+		if err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// Anything after the last event
+	_, err := io.Copy(w, body)
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsEventStream(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"text/event-stream":                true,
+		"text/event-stream; charset=utf-8": true,
+		"text/plain":                       false,
+		"":                                 false,
+	} {
+		header := http.Header{"Content-Type": {contentType}}
+		if actual := isEventStream(header); actual != expected {
+			t.Errorf("Got: `%v`; Expected: `%v` for `%v`", actual, expected, contentType)
+		}
+	}
+}
+
+func TestEventScanner(t *testing.T) {
+	scanner := newEventScanner()
+	_, _ = scanner.Write([]byte("data: one\n\nda"))
+	_, _ = scanner.Write([]byte("ta: two\r\n\r\ndata: partial\n"))
+
+	var ends []int64
+	for _, event := range scanner.events {
+		ends = append(ends, event.End)
+	}
+	expected := []int64{11, 24}
+	if !reflect.DeepEqual(ends, expected) {
+		t.Errorf("Got: `%v`; Expected: `%v`", ends, expected)
+	}
+	if scanner.end() != 24 {
+		t.Errorf("Got: `%v`; Expected: `24`", scanner.end())
+	}
+}
+
+func TestReplayEvents(t *testing.T) {
+	body := "data: one\n\ndata: two\n\n"
+	events := []EventTiming{{End: 11, Delay: 0}, {End: 22, Delay: 100}}
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	err := replayEvents(w, strings.NewReader(body), events, 0.5)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Errorf("Unexpected error: `%v`", err)
+	}
+	if w.Body.String() != body {
+		t.Errorf("Got: `%v`; Expected: `%v`", w.Body.String(), body)
+	}
+	if elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Got: `%v`; Expected the scaled delay of 50ms", elapsed)
+	}
+	if !w.Flushed {
+		t.Errorf("Expected events to be flushed")
+	}
+}
+
+func TestCachedProxyHandlerRecordsEventStream(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, "data: two\n\ndata: part")
+		w.(http.Flusher).Flush()
+		// Keep the stream open until the client goes away
+		<-r.Context().Done()
+		close(done)
+	}))
+	defer upstream.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := mockCacher{data: make(map[string]*CachedResponse)}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	reader := bufio.NewReader(resp.Body)
+	for _, expected := range []string{"data: one\n", "\n", "data: two\n", "\n"} {
+		line, _ := reader.ReadString('\n')
+		if line != expected {
+			t.Errorf("Got: `%v`; Expected: `%v`", line, expected)
+		}
+	}
+	hash := resp.Header.Get("chameleon-request-hash")
+	resp.Body.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Upstream stream was not closed when the client disconnected")
+	}
+	// Closing the server waits for the handler to finish recording
+	server.Close()
+	response := cache.Get(hash)
+	if response == nil {
+		t.Fatalf("Expected the event stream to be recorded")
+	}
+	if string(response.Body) != "data: one\n\ndata: two\n\n" {
+		t.Errorf("Got: `%v`; Expected the complete events to be recorded", string(response.Body))
+	}
+	if len(response.Events) != 2 || response.Events[1].Delay < 20 {
+		t.Errorf("Got: `%v`; Expected two events, the second delayed by at least 20ms", response.Events)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/events", nil)
+	handler.ServeHTTP(w, req)
+	if w.Body.String() != "data: one\n\ndata: two\n\n" {
+		t.Errorf("Got: `%v`; Expected the events to be replayed", w.Body.String())
+	}
+}
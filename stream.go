@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// recordingWriter streams a response to the client while saving a copy of its body to a temporary file.
+type recordingWriter struct {
+	http.ResponseWriter
+	hash        string
+	header      http.Header
+	code        int
+	wroteHeader bool
+	file        *os.File
+	size        int64
+	maxSize     int64
+	// start is when the request was sent upstream, and firstByte how long the headers took to arrive
+	start     time.Time
+	firstByte time.Duration
+	// events finds the events in text/event-stream responses
+	events *eventScanner
+	// rewriter rewrites URLs in the response sent to the client, though not in the recording
+	rewriter *urlRewriter
+	// body rewrites the URLs in the body sent to the client, if needed
+	body *rewritingWriter
+	// cookies rewrites the cookies sent to the client
+	cookies *cookieRewriter
+	// err is set once the body can't be recorded, e.g. because it is too large
+	err error
+}
+
+func (rw *recordingWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.code = code
+	rw.firstByte = time.Since(rw.start)
+
+	if isEventStream(rw.header) {
+		rw.events = newEventScanner()
+	}
+
+	clientHeader := rw.ResponseWriter.Header()
+	copyHeaders(clientHeader, rw.header)
+	if rw.rewriter != nil {
+		rw.rewriter.rewriteHeaders(clientHeader)
+		if rw.rewriter.rewritesBody(rw.header) {
+			clientHeader.Del("Content-Length")
+			rw.body = &rewritingWriter{ResponseWriter: rw.ResponseWriter, rewriter: rw.rewriter}
+		}
+	}
+	if rw.cookies != nil {
+		rw.cookies.rewriteHeaders(clientHeader)
+	}
+	clientHeader.Add("chameleon-request-hash", rw.hash)
+	clientHeader.Set("chameleon-cache", cacheMiss)
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	var client io.Writer = rw.ResponseWriter
+	if rw.body != nil {
+		client = rw.body
+	}
+	n, err := client.Write(p)
+	if rw.err == nil {
+		rw.size += int64(n)
+		if rw.maxSize > 0 && rw.size > rw.maxSize {
+			rw.err = errTooLarge
+		} else {
+			_, rw.err = rw.file.Write(p[:n])
+		}
+		if rw.events != nil {
+			_, _ = rw.events.Write(p[:n])
+		}
+	}
+	rw.Flush()
+	return n, err
+}
+
+// Flush sends any buffered data to the client, so long responses are streamed as they arrive.
+func (rw *recordingWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type recordError string
+
+func (e recordError) Error() string {
+	return string(e)
+}
+
+const errTooLarge = recordError("response is larger than the maximum record size")
+
+// recordResponse proxies r, streaming the response to w, and stores it in cacher once it is complete.
+// URLs and cookies in the response sent to w are rewritten by rewriter and cookies, if they aren't nil.
+func recordResponse(w http.ResponseWriter, r *http.Request, hash string, cacher Cacher, options ProxyOptions,
+	rewriter *urlRewriter, cookies *cookieRewriter) {
+	file, err := ioutil.TempFile("", "chameleon")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		// If this fails, there isn't much to do
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+
+	rec := &recordingWriter{
+		ResponseWriter: w,
+		hash:           hash,
+		header:         make(http.Header),
+		file:           file,
+		maxSize:        options.MaxRecordSize,
+		start:          time.Now(),
+		rewriter:       rewriter,
+		cookies:        cookies,
+	}
+	err = proxy(rec, r, options.client())
+	if rec.body != nil {
+		// If this fails, there isn't much to do
+		_ = rec.body.Close()
+	}
+	if err != nil && rec.events != nil {
+		// Event streams end when either side goes away, so record up to the last complete event
+		log.Printf("-> Event stream [%v] ended: %v\n", hash, err)
+		err = nil
+	}
+	if err == nil {
+		err = rec.err
+	}
+	if err == nil {
+		_, err = file.Seek(0, 0)
+	}
+	if err != nil {
+		log.Printf("-> Not recording [%v]: %v\n", hash, err)
+		return
+	}
+	if _, ok := w.(*faultWriter); ok {
+		// The fault slowed the response down, so its latency isn't the proxied service's
+		log.Printf("-> Not recording [%v]: a fault was injected\n", hash)
+		return
+	}
+
+	recording := &Recording{
+		StatusCode: rec.code,
+		Header:     rec.header,
+		Body:       file,
+		Latency: &Latency{
+			FirstByte: int64(rec.firstByte / time.Millisecond),
+			Total:     int64(time.Since(rec.start) / time.Millisecond),
+		},
+	}
+	if rec.events != nil {
+		recording.Body = io.LimitReader(file, rec.events.end())
+		recording.Events = rec.events.events
+	} else if encoding := decodableEncoding(rec.header.Get("Content-Encoding")); encoding != "" && rec.size > 0 {
+		// Store the body decoded, so it can be replayed to clients which don't accept the encoding
+		recording.Body, err = decodeContent(file, encoding)
+		if err != nil {
+			log.Printf("-> Not recording [%v]: %v\n", hash, err)
+			return
+		}
+		recording.Encoding = encoding
+		recording.Header = make(http.Header)
+		copyHeaders(recording.Header, rec.header)
+		recording.Header.Del("Content-Encoding")
+		recording.Header.Del("Content-Length")
+	}
+	_, err = cacher.Record(hash, recording)
+	if err != nil {
+		log.Printf("-> Unable to record [%v]: %v\n", hash, err)
+	}
+}
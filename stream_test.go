@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachedProxyHandlerStreams(t *testing.T) {
+	firstChunkReceived := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "FIRST\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-firstChunkReceived:
+		case <-time.After(time.Second):
+			t.Errorf("First chunk was not streamed to the client")
+		}
+		fmt.Fprint(w, "SECOND\n")
+	}))
+	defer upstream.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := mockCacher{data: make(map[string]*CachedResponse)}
+	server := httptest.NewServer(CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stream")
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("chameleon-request-hash") == "" {
+		t.Errorf("Hash was not returned with response.")
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	line, _ := reader.ReadString('\n')
+	if line != "FIRST\n" {
+		t.Errorf("Got: `%v`; Expected: `FIRST`", line)
+	}
+	close(firstChunkReceived)
+	rest, _ := ioutil.ReadAll(reader)
+	if string(rest) != "SECOND\n" {
+		t.Errorf("Got: `%v`; Expected: `SECOND`", string(rest))
+	}
+
+	hash := resp.Header.Get("chameleon-request-hash")
+	if response := cache.data[hash]; response == nil || string(response.Body) != "FIRST\nSECOND\n" {
+		t.Errorf("Got: `%v`; Expected the full response to be recorded", response)
+	} else if response.Headers["Content-Type"] != "text/plain" {
+		t.Errorf("Got: `%v`; Expected: `text/plain`", response.Headers["Content-Type"])
+	} else if response.Latency == nil || response.Latency.Total < response.Latency.FirstByte {
+		t.Errorf("Got: `%+v`; Expected the latency to be recorded", response.Latency)
+	}
+}
+
+func TestCachedProxyHandlerMaxRecordSize(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "THIS IS TOO LARGE")
+	}))
+	defer upstream.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := mockCacher{data: make(map[string]*CachedResponse)}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{MaxRecordSize: 5})
+
+	req, _ := http.NewRequest("GET", upstream.URL+"/large", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Body.String() != "THIS IS TOO LARGE" {
+		t.Errorf("Got: `%v`; Expected: `THIS IS TOO LARGE`", w.Body.String())
+	}
+	if len(cache.data) != 0 {
+		t.Errorf("Response larger than the maximum record size was recorded")
+	}
+}
+
+func TestCachedProxyHandlerIncompleteResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		fmt.Fprint(w, "TRUNCATED")
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer upstream.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := mockCacher{data: make(map[string]*CachedResponse)}
+	handler := CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{})
+
+	req, _ := http.NewRequest("GET", upstream.URL+"/truncated", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(cache.data) != 0 {
+		t.Errorf("Incomplete response was recorded")
+	}
+}
+
+func TestCachedProxyHandlerDoesNotRecordUpstreamErrors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	client, _ := UpstreamConfig{ResponseTimeout: 10 * time.Millisecond}.Client()
+
+	for _, server := range []*httptest.Server{slow, refused} {
+		serverURL, _ := url.Parse(server.URL)
+		cacher := mockCacher{data: make(map[string]*CachedResponse)}
+		handler := CachedProxyHandler(serverURL, cacher, DefaultHasher{}, ProxyOptions{Client: client})
+
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != 500 {
+			t.Errorf("Got: `%v`; Expected: `%v`", w.Code, 500)
+		}
+		if len(cacher.data) != 0 {
+			t.Errorf("Got: `%v`; Expected the failed request not to be recorded", cacher.data)
+		}
+	}
+}
+
+func TestDiskCacherRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+
+	cacher := NewDiskCacher(dir)
+	cacher.Sharded = true
+	header := http.Header{"Foo": []string{"Bar", "Baz"}}
+	response, err := cacher.Record("key", &Recording{StatusCode: 201, Header: header, Body: strings.NewReader("STREAMED")})
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if string(response.Body) != "STREAMED" || response.Headers["Foo"] != "Bar, Baz" {
+		t.Errorf("Got: `%+v`; Expected the recorded response", response)
+	}
+
+	files, _ := cacher.ListFiles(dir)
+	expected := shardedName(contentName([]byte("STREAMED")))
+	if len(files) != 2 || files[0] != expected || files[1] != "spec.json" {
+		t.Errorf("Got: `%v`; Expected: `[%v spec.json]`", files, expected)
+	}
+}
+
+func TestDiskCacherRecordReplacesKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	cacher := NewDiskCacher(dir)
+	cacher.Strict = true
+
+	// Concurrent misses for the same key each record the response
+	for _, body := range []string{"FIRST", "SECOND"} {
+		if _, err := cacher.Record("key", &Recording{StatusCode: 200, Body: strings.NewReader(body)}); err != nil {
+			t.Fatalf("Unexpected error: `%v`", err)
+		}
+	}
+
+	if err := cacher.SeedCache(); err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	specs, _, _ := cacher.readSpecs()
+	if len(specs) != 1 {
+		t.Errorf("Got: `%v`; Expected: `%v`", len(specs), 1)
+	}
+	if body := string(cacher.Get("key").Body); body != "SECOND" {
+		t.Errorf("Got: `%v`; Expected: `%v`", body, "SECOND")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	cert, err := selfSignedCertificate([]string{"chameleon.local", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+
+	for _, host := range []string{"chameleon.local", "127.0.0.1"} {
+		if _, err := parsed.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("Got: `%v`; Expected a certificate valid for `%v`", err, host)
+		}
+	}
+}
+
+func TestSelfSignedHosts(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected []string
+	}{
+		{"localhost:6005", []string{"localhost", "127.0.0.1", "::1"}},
+		{":6005", []string{"localhost", "127.0.0.1", "::1"}},
+		{"chameleon.local:6005", []string{"chameleon.local", "localhost", "127.0.0.1", "::1"}},
+	}
+
+	for _, test := range tests {
+		if hosts := selfSignedHosts(test.addr); !reflect.DeepEqual(hosts, test.expected) {
+			t.Errorf("Got: `%v`; Expected: `%v`", hosts, test.expected)
+		}
+	}
+}
+
+func protoServer(useTLS, h2c bool) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	server.Config.Protocols = serverProtocols(useTLS, h2c)
+	if useTLS {
+		server.EnableHTTP2 = true
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	return server
+}
+
+func TestServerProtocolsH2C(t *testing.T) {
+	for _, h2c := range []bool{true, false} {
+		server := protoServer(false, h2c)
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		transport := &http.Transport{Protocols: protocols}
+
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != h2c || (err == nil && resp.ProtoMajor != 2) {
+			t.Errorf("Got: `%v` (%v); Expected HTTP/2 to be accepted: `%v`", resp, err, h2c)
+		}
+		transport.CloseIdleConnections()
+		server.Close()
+	}
+}
+
+func TestServerProtocolsTLS(t *testing.T) {
+	server := protoServer(true, false)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Got: `%v`; Expected: `%v`", resp.Proto, "HTTP/2.0")
+	}
+	if resp.TLS == nil || resp.TLS.Version < tls.VersionTLS12 {
+		t.Errorf("Got: `%v`; Expected a TLS connection", resp.TLS)
+	}
+}
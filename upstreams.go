@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// UpstreamRoute sends the requests for a path prefix, a Host, or both, to another upstream,
+// recorded in its own data directory.
+type UpstreamRoute struct {
+	Prefix string `json:"prefix,omitempty"`
+	Host   string `json:"host,omitempty"`
+	URL    string `json:"url"`
+	Data   string `json:"data"`
+	// Hasher is a custom hasher program for this route's requests
+	Hasher string `json:"hasher,omitempty"`
+}
+
+// patterns returns the ServeMux patterns which match the route's requests.
+func (u UpstreamRoute) patterns() []string {
+	prefix := u.Prefix
+	if prefix == "" {
+		prefix = "/"
+	}
+	if strings.HasSuffix(prefix, "/") {
+		return []string{u.Host + prefix}
+	}
+	// Match the prefix itself, and everything under it
+	return []string{u.Host + prefix, u.Host + prefix + "/"}
+}
+
+// ReadUpstreamRoutes reads a JSON list of routes from path, checking that each route is complete
+// and has a data directory of its own. dataDir is the data directory for requests no route matches, if any.
+func ReadUpstreamRoutes(path, dataDir string) ([]UpstreamRoute, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes []UpstreamRoute
+	if err = json.Unmarshal(content, &routes); err != nil {
+		return nil, jsonError(path, content, 0, err)
+	}
+
+	dirs := make(map[string]bool)
+	patterns := make(map[string]bool)
+	if dataDir != "" {
+		// Requests no route matches go to the default upstream
+		dirs[filepath.Clean(dataDir)] = true
+		patterns["/"] = true
+	}
+	for i, route := range routes {
+		var problem string
+		serverURL, err := url.Parse(route.URL)
+		switch {
+		case route.Prefix == "" && route.Host == "":
+			problem = "one of prefix or host is required"
+		case route.Prefix != "" && !strings.HasPrefix(route.Prefix, "/"):
+			problem = fmt.Sprintf("prefix %q must start with /", route.Prefix)
+		case err != nil || serverURL.Scheme == "" || serverURL.Host == "":
+			problem = fmt.Sprintf("url %q must be an absolute URL", route.URL)
+		case route.Data == "":
+			problem = "data is required"
+		case dirs[filepath.Clean(route.Data)]:
+			problem = fmt.Sprintf("data directory %q is used more than once", route.Data)
+		}
+		for _, pattern := range route.patterns() {
+			if problem == "" && patterns[pattern] {
+				problem = fmt.Sprintf("%q is routed more than once", pattern)
+			}
+			patterns[pattern] = true
+		}
+		if problem != "" {
+			return nil, fmt.Errorf("%v: route %d: %v", path, i, problem)
+		}
+		dirs[filepath.Clean(route.Data)] = true
+	}
+	return routes, nil
+}
+
+// Reloaders reloads several caches at once.
+type Reloaders []Reloader
+
+// Reload reloads every cache, returning the first error.
+func (r Reloaders) Reload() error {
+	var firstErr error
+	for _, reloader := range r {
+		if err := reloader.Reload(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeRoutes(t *testing.T, content string) (string, func()) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	file := path.Join(dir, "routes.json")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	return file, func() { os.RemoveAll(dir) }
+}
+
+func TestReadUpstreamRoutes(t *testing.T) {
+	file, cleanup := writeRoutes(t, `[
+		{"prefix": "/users", "url": "https://users.example.com", "data": "./users"},
+		{"host": "billing.local", "url": "https://billing.example.com", "data": "./billing", "hasher": "./hash.py"}
+	]`)
+	defer cleanup()
+
+	routes, err := ReadUpstreamRoutes(file, "./default")
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	expected := []UpstreamRoute{
+		{Prefix: "/users", URL: "https://users.example.com", Data: "./users"},
+		{Host: "billing.local", URL: "https://billing.example.com", Data: "./billing", Hasher: "./hash.py"},
+	}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("Got: `%v`; Expected: `%v`", routes, expected)
+	}
+}
+
+func TestReadUpstreamRoutesInvalid(t *testing.T) {
+	tests := []struct {
+		content string
+		problem string
+	}{
+		{`{"prefix": "/users"}`, "cannot unmarshal"},
+		{`[{"url": "https://users.example.com", "data": "./users"}]`, "route 0: one of prefix or host is required"},
+		{`[{"prefix": "users", "url": "https://users.example.com", "data": "./users"}]`, `route 0: prefix "users" must start with /`},
+		{`[{"prefix": "/users", "url": "users.example.com", "data": "./users"}]`, `route 0: url "users.example.com" must be an absolute URL`},
+		{`[{"prefix": "/users", "url": "https://users.example.com"}]`, "route 0: data is required"},
+		{`[{"prefix": "/users", "url": "https://users.example.com", "data": "default/"}]`, `route 0: data directory "default/" is used more than once`},
+		{`[{"prefix": "/users", "url": "https://users.example.com", "data": "./users"},
+		   {"prefix": "/users/", "url": "https://users.example.com", "data": "./other"}]`, `route 1: "/users/" is routed more than once`},
+		{`[{"prefix": "/", "url": "https://users.example.com", "data": "./users"}]`, `route 0: "/" is routed more than once`},
+	}
+
+	for _, test := range tests {
+		file, cleanup := writeRoutes(t, test.content)
+		_, err := ReadUpstreamRoutes(file, "./default")
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("Got: `%v`; Expected: `%v`", err, test.problem)
+		}
+	}
+}
+
+func TestUpstreamRoutePatterns(t *testing.T) {
+	tests := []struct {
+		route    UpstreamRoute
+		expected []string
+	}{
+		{UpstreamRoute{Prefix: "/users"}, []string{"/users", "/users/"}},
+		{UpstreamRoute{Prefix: "/users/"}, []string{"/users/"}},
+		{UpstreamRoute{Host: "billing.local"}, []string{"billing.local/"}},
+		{UpstreamRoute{Host: "billing.local", Prefix: "/v2"}, []string{"billing.local/v2", "billing.local/v2/"}},
+	}
+
+	for _, test := range tests {
+		if patterns := test.route.patterns(); !reflect.DeepEqual(patterns, test.expected) {
+			t.Errorf("Got: `%v`; Expected: `%v`", patterns, test.expected)
+		}
+	}
+}
+
+type funcReloader func() error
+
+func (f funcReloader) Reload() error {
+	return f()
+}
+
+func TestReloadersReloadsEverything(t *testing.T) {
+	reloaded := 0
+	failed := errors.New("failed")
+	reloaders := Reloaders{
+		funcReloader(func() error { reloaded++; return failed }),
+		funcReloader(func() error { reloaded++; return nil }),
+	}
+
+	if err := reloaders.Reload(); err != failed {
+		t.Errorf("Got: `%v`; Expected: `%v`", err, failed)
+	}
+	if reloaded != 2 {
+		t.Errorf("Got: `%v`; Expected: `%v`", reloaded, 2)
+	}
+}
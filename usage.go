@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Usage records how often a cached response has been served.
+type Usage struct {
+	Hits     int       `json:"hits"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// usageRun records when chameleon was last run with usage tracking.
+type usageRun struct {
+	Started time.Time `json:"started"`
+	Stopped time.Time `json:"stopped"`
+}
+
+// usageRecord is the format of usage.json, which is kept alongside spec.json.
+type usageRecord struct {
+	LastRun usageRun          `json:"last_run"`
+	Keys    map[string]*Usage `json:"keys"`
+}
+
+// touch records a use of the response for key.
+func (c *DiskCacher) touch(key string) {
+	c.usageMutex.Lock()
+	defer c.usageMutex.Unlock()
+
+	usage, ok := c.usage[key]
+	if !ok {
+		usage = &Usage{}
+		c.usage[key] = usage
+	}
+	usage.Hits++
+	usage.LastUsed = time.Now()
+}
+
+// readUsage reads the usage saved in the data directory.
+func (c *DiskCacher) readUsage() (*usageRecord, error) {
+	content, err := c.FileSystem.ReadFile(c.usagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var record usageRecord
+	err = json.Unmarshal(content, &record)
+	if err != nil {
+		return nil, jsonError(c.usagePath, content, 0, err)
+	}
+	if record.Keys == nil {
+		record.Keys = make(map[string]*Usage)
+	}
+	return &record, nil
+}
+
+// currentUsage merges the usage saved in the data directory with the usage recorded since the cacher was created.
+func (c *DiskCacher) currentUsage() *usageRecord {
+	record, err := c.readUsage()
+	if err != nil {
+		record = &usageRecord{Keys: make(map[string]*Usage)}
+	}
+
+	c.usageMutex.Lock()
+	defer c.usageMutex.Unlock()
+
+	for key, usage := range c.usage {
+		saved, ok := record.Keys[key]
+		if !ok {
+			saved = &Usage{}
+			record.Keys[key] = saved
+		}
+		saved.Hits += usage.Hits
+		if usage.LastUsed.After(saved.LastUsed) {
+			saved.LastUsed = usage.LastUsed
+		}
+	}
+	record.LastRun = usageRun{Started: c.started, Stopped: time.Now()}
+	return record
+}
+
+// SaveUsage writes the usage recorded since the cacher was created to usage.json, adding to any usage saved before.
+// Keys which are no longer cached are dropped.
+func (c *DiskCacher) SaveUsage() error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	record := c.currentUsage()
+	for key := range record.Keys {
+		if _, ok := c.cache[key]; !ok {
+			delete(record.Keys, key)
+		}
+	}
+
+	content, err := json.MarshalIndent(record, "", "    ")
+	if err != nil {
+		return err
+	}
+	return c.FileSystem.WriteFile(c.usagePath, content)
+}
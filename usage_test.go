@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDiskCacherTracksUsage(t *testing.T) {
+	cacher := NewDiskCacher("")
+	cacher.FileSystem = mockFileSystem{}
+	_ = cacher.SeedCache()
+
+	cacher.Get("key")
+	cacher.Get("key")
+	cacher.Get("unknown")
+	_ = cacher.Put("new_key", httptest.NewRecorder())
+
+	if usage := cacher.usage["key"]; usage == nil || usage.Hits != 2 {
+		t.Errorf("Got: `%v`; Expected 2 hits", usage)
+	}
+	if usage := cacher.usage["new_key"]; usage == nil || usage.Hits != 1 {
+		t.Errorf("Got: `%v`; Expected 1 hit", usage)
+	}
+	if _, ok := cacher.usage["unknown"]; ok {
+		t.Errorf("Usage was recorded for a missing key")
+	}
+}
+
+func TestDiskCacherSaveUsage(t *testing.T) {
+	fs := mapFileSystem{
+		"spec.json": []byte(`[{"key": "key", "response": {"status_code": 200, "content": "key"}}]`),
+		"key":       []byte("CONTENT"),
+		"usage.json": []byte(`{"keys": {
+			"key": {"hits": 3, "last_used": "2015-01-01T00:00:00Z"},
+			"gone": {"hits": 1, "last_used": "2015-01-01T00:00:00Z"}
+		}}`),
+	}
+	cacher := NewDiskCacher("")
+	cacher.FileSystem = fs
+	_ = cacher.SeedCache()
+	cacher.Get("key")
+
+	err := cacher.SaveUsage()
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+
+	record, err := cacher.readUsage()
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if usage := record.Keys["key"]; usage == nil || usage.Hits != 4 || time.Since(usage.LastUsed) > time.Minute {
+		t.Errorf("Got: `%v`; Expected 4 hits, used just now", usage)
+	}
+	if _, ok := record.Keys["gone"]; ok {
+		t.Errorf("Usage was saved for a key which is no longer cached")
+	}
+	if !record.LastRun.Started.Equal(cacher.started) {
+		t.Errorf("Got: `%v`; Expected: `%v`", record.LastRun.Started, cacher.started)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A SpecError describes a problem with a single entry in spec.json.
+type SpecError struct {
+	Index int
+	Key   string
+	Msg   string
+}
+
+func (e *SpecError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("entry %d: %v", e.Index, e.Msg)
+	}
+	return fmt.Sprintf("entry %d (key %q): %v", e.Index, e.Key, e.Msg)
+}
+
+// SpecErrors is a list of every problem found while loading a data directory.
+type SpecErrors []*SpecError
+
+func (e SpecErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// jsonPosition converts a byte offset in data to a 1-based line and column.
+func jsonPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte{'\n'}) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// jsonError annotates a JSON decoding error with the line and column it occurred at.
+func jsonError(name string, data []byte, base int64, err error) error {
+	var offset int64
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset = err.Offset
+	case *json.UnmarshalTypeError:
+		offset = err.Offset
+	default:
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	line, col := jsonPosition(data, base+offset)
+	return fmt.Errorf("%v:%d:%d: %v", name, line, col, err)
+}
+
+// parseSpecs decodes the entries in a spec file.
+// The returned slice has one element per entry; entries which could not be decoded are nil
+// and reported in the returned SpecErrors. An error is returned if the file itself is malformed.
+func parseSpecs(name string, data []byte) ([]*Spec, SpecErrors, error) {
+	var raw []json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&raw); err != nil {
+		if err == io.EOF {
+			return nil, nil, nil
+		}
+		return nil, nil, jsonError(name, data, 0, err)
+	}
+
+	specs := make([]*Spec, len(raw))
+	var problems SpecErrors
+	var start int64
+	for i, entry := range raw {
+		// Entries are kept verbatim, so the first match after the previous entry is this entry
+		start += int64(bytes.Index(data[start:], entry))
+		var spec Spec
+		err := json.Unmarshal(entry, &spec)
+		if err != nil {
+			problems = append(problems, &SpecError{Index: i, Msg: jsonError(name, data, start, err).Error()})
+		} else {
+			specs[i] = &spec
+		}
+		start += int64(len(entry))
+	}
+	return specs, problems, nil
+}
+
+// insideDataDir reports whether name, a content file path relative to the data directory, stays inside it.
+func insideDataDir(name string) bool {
+	name = path.Clean(filepath.ToSlash(name))
+	return name != ".." && !strings.HasPrefix(name, "../") && !path.IsAbs(name) && !filepath.IsAbs(name) &&
+		filepath.VolumeName(name) == ""
+}
+
+// validateSpec checks an entry for problems which don't depend on other entries or files.
+func validateSpec(spec *Spec) string {
+	if spec.Key == "" {
+		return "missing key"
+	}
+	if spec.StatusCode < 100 || spec.StatusCode > 999 {
+		return fmt.Sprintf("invalid status code %d", spec.StatusCode)
+	}
+	if spec.ContentFile == "" {
+		return "missing content file"
+	}
+	if !insideDataDir(spec.ContentFile) {
+		return fmt.Sprintf("content file %q is outside the data directory", spec.ContentFile)
+	}
+	if _, err := compressContent(nil, spec.Compression); err != nil {
+		return err.Error()
+	}
+	return ""
+}
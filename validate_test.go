@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSONPosition(t *testing.T) {
+	data := []byte("[\n    {\n  x")
+	line, col := jsonPosition(data, int64(len(data)-1))
+	if line != 3 || col != 3 {
+		t.Errorf("Got: `%v:%v`; Expected: `3:3`", line, col)
+	}
+}
+
+func TestParseSpecsSyntaxError(t *testing.T) {
+	_, _, err := parseSpecs("spec.json", []byte("[\n    {\"key\": \"a\",}\n]"))
+	if err == nil {
+		t.Fatalf("Expected an error for malformed JSON")
+	}
+	if !strings.HasPrefix(err.Error(), "spec.json:2:") {
+		t.Errorf("Got: `%v`; Expected the line and column of the error", err)
+	}
+}
+
+func TestParseSpecsBadEntry(t *testing.T) {
+	content := `[
+    {"key": "good", "response": {"status_code": 200}},
+    {"key": "bad", "response": {"status_code": "200"}}
+]`
+	specs, problems, err := parseSpecs("spec.json", []byte(content))
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if len(specs) != 2 || specs[0] == nil || specs[1] != nil {
+		t.Errorf("Got: `%v`; Expected only the first entry to be decoded", specs)
+	}
+	if len(problems) != 1 || problems[0].Index != 1 {
+		t.Fatalf("Got: `%v`; Expected a problem with entry 1", problems)
+	}
+	if !strings.Contains(problems[0].Msg, "spec.json:3:") {
+		t.Errorf("Got: `%v`; Expected the line of the bad entry", problems[0].Msg)
+	}
+}
+
+func TestParseSpecsEmpty(t *testing.T) {
+	specs, problems, err := parseSpecs("spec.json", []byte(""))
+	if err != nil || len(specs) != 0 || len(problems) != 0 {
+		t.Errorf("Got: `%v`, `%v`, `%v`; Expected no specs or errors", specs, problems, err)
+	}
+}
+
+func TestValidateSpecContentOutsideDataDir(t *testing.T) {
+	tests := []struct {
+		content string
+		inside  bool
+	}{
+		{"body.json", true},
+		{"ab/cd/abcdef", true},
+		{"bodies/../body.json", true},
+		{"../shared/body.json", false},
+		{"bodies/../../body.json", false},
+		{"..", false},
+		{"/etc/passwd", false},
+	}
+
+	for _, test := range tests {
+		spec := &Spec{Key: "key", SpecResponse: SpecResponse{StatusCode: 200, ContentFile: test.content}}
+		problem := validateSpec(spec)
+		if (problem == "") != test.inside {
+			t.Errorf("Got: `%v`; Expected `%v` inside the data directory: `%v`", problem, test.content, test.inside)
+		}
+	}
+}
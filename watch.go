@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isDataDir reports whether dir is a data directory, with a spec.json of its own.
+func isDataDir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, "spec.json"))
+	return err == nil && !info.IsDir()
+}
+
+// watchedFile reports whether a change to p, under the data directory dir, may need a reload.
+// Hidden and temporary files, usage.json and other data directories nested in dir are skipped.
+func watchedFile(dir, p string, info os.FileInfo) bool {
+	if p == dir {
+		return true
+	}
+	name := info.Name()
+	if strings.HasPrefix(name, ".") || (info.IsDir() && isDataDir(p)) {
+		return false
+	}
+	return info.IsDir() || (name != "usage.json" && !strings.HasSuffix(name, ".tmp"))
+}
+
+// A fileState is the size and modification time of a file. Missing files have the zero fileState.
+type fileState struct {
+	size    int64
+	modTime int64
+}
+
+func statFile(name string) fileState {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{info.Size(), info.ModTime().UnixNano()}
+}
+
+// dirFiles returns the state of every file under dir which may need a reload when it changes.
+func dirFiles(dir string) (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !watchedFile(dir, p, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			files[p] = fileState{info.Size(), info.ModTime().UnixNano()}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ownFiles tracks the files in a watched directory, as they were when it was last polled and as chameleon
+// changed them since. A file changed by anything else, even one chameleon then changes too, calls for a reload.
+type ownFiles struct {
+	mutex sync.Mutex
+	// files is nil until the directory is watched
+	files map[string]fileState
+	stale bool
+}
+
+// track runs change, which writes or removes the file name, and notes the result as chameleon's own change.
+func (o *ownFiles) track(name string, change func() error) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.files == nil {
+		return change()
+	}
+
+	name = filepath.Clean(filepath.FromSlash(name))
+	if statFile(name) != o.files[name] {
+		o.stale = true
+	}
+	err := change()
+	if state := statFile(name); state != (fileState{}) {
+		o.files[name] = state
+	} else {
+		delete(o.files, name)
+	}
+	return err
+}
+
+// update replaces the tracked files with the ones found by polling,
+// and reports whether anything but chameleon changed them since the last poll.
+func (o *ownFiles) update(files map[string]fileState) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	changed := o.stale || len(files) != len(o.files)
+	for name, state := range files {
+		if known, ok := o.files[name]; !ok || known != state {
+			changed = true
+		}
+	}
+	o.files = files
+	o.stale = false
+	return changed
+}
+
+// WatchDir polls dir every interval and calls reload whenever its files change.
+// Changes tracked by own, which may be nil, don't call for a reload. It returns when stop is closed.
+func WatchDir(dir string, interval time.Duration, reload func() error, own *ownFiles, stop <-chan struct{}) {
+	if own == nil {
+		own = new(ownFiles)
+	}
+	files, err := dirFiles(dir)
+	if err != nil {
+		log.Printf("Unable to watch %v: %v\n", dir, err)
+		files = make(map[string]fileState)
+	}
+	own.update(files)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		files, err := dirFiles(dir)
+		if err != nil {
+			log.Printf("Unable to watch %v: %v\n", dir, err)
+			continue
+		}
+		if !own.update(files) {
+			continue
+		}
+
+		log.Printf("Reloading %v\n", dir)
+		if err := reload(); err != nil {
+			log.Printf("Unable to reload %v: %v\n", dir, err)
+		}
+	}
+}
+
+// Watch polls the data directory every interval, and reloads it whenever its files are changed
+// by anything but the cacher. It returns when stop is closed.
+func (c *DiskCacher) Watch(interval time.Duration, stop <-chan struct{}) {
+	WatchDir(c.dataDir, interval, c.Reload, c.own, stop)
+}
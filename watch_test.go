@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+
+	_ = ioutil.WriteFile(path.Join(dir, "spec.json"), []byte("[]"), 0644)
+	_ = os.MkdirAll(path.Join(dir, "ab", "cd"), 0755)
+	_ = ioutil.WriteFile(path.Join(dir, "ab", "cd", "abcdef"), []byte("CONTENT"), 0644)
+	files, err := dirFiles(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+
+	if len(files) != 2 || files[path.Join(dir, "spec.json")].size != 2 || files[path.Join(dir, "ab", "cd", "abcdef")].size != 7 {
+		t.Errorf("Got: `%v`; Expected spec.json and the content file", files)
+	}
+}
+
+func TestWatchDir(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+
+	reloaded := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go WatchDir(dir, 10*time.Millisecond, func() error {
+		reloaded <- struct{}{}
+		return nil
+	}, nil, stop)
+
+	time.Sleep(30 * time.Millisecond)
+	_ = ioutil.WriteFile(path.Join(dir, "spec.json"), []byte("[]"), 0644)
+
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Errorf("Reload was not called after the directory changed")
+	}
+}
+
+func TestDirFilesIgnoresOwnFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(path.Join(dir, "spec.json"), []byte("[]"), 0644)
+
+	_ = ioutil.WriteFile(path.Join(dir, "usage.json"), []byte("{}"), 0644)
+	_ = ioutil.WriteFile(path.Join(dir, ".chameleon-1-1.tmp"), []byte("partial"), 0644)
+	_ = ioutil.WriteFile(path.Join(dir, ".hidden"), []byte("hidden"), 0644)
+	_ = os.MkdirAll(path.Join(dir, "example.com"), 0755)
+	_ = ioutil.WriteFile(path.Join(dir, "example.com", "spec.json"), []byte("[]"), 0644)
+
+	if files, _ := dirFiles(dir); len(files) != 1 {
+		t.Errorf("Got: `%v`; Expected only spec.json", files)
+	}
+}
+
+func TestOwnFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	specPath := path.Join(dir, "spec.json")
+	write := func(content string) func() error {
+		return func() error {
+			return ioutil.WriteFile(specPath, []byte(content), 0644)
+		}
+	}
+
+	own := new(ownFiles)
+	if err := own.track(specPath, write("[]")); err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	files, _ := dirFiles(dir)
+	if !own.update(files) {
+		t.Errorf("Got: `false`; Expected changes before the directory is watched to count")
+	}
+
+	_ = own.track(specPath, write("[{}]"))
+	files, _ = dirFiles(dir)
+	if own.update(files) {
+		t.Errorf("Got: `true`; Expected chameleon's own change not to count")
+	}
+
+	// Edited by hand, then changed by chameleon before the next poll
+	_ = write("[{}, {}]")()
+	_ = own.track(specPath, write("[{}, {}, {}]"))
+	files, _ = dirFiles(dir)
+	if !own.update(files) {
+		t.Errorf("Got: `false`; Expected an edit overwritten by chameleon to count")
+	}
+
+	_ = own.track(specPath, func() error { return os.Remove(specPath) })
+	files, _ = dirFiles(dir)
+	if own.update(files) {
+		t.Errorf("Got: `true`; Expected chameleon's own removal not to count")
+	}
+}
+
+func TestDiskCacherWatchReloadsEditsBeforeRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chameleon")
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(path.Join(dir, "spec.json"), []byte("[]"), 0644)
+	cacher := NewDiskCacher(dir)
+	_ = cacher.SeedCache()
+	stop := make(chan struct{})
+	defer close(stop)
+	go cacher.Watch(50*time.Millisecond, stop)
+	time.Sleep(10 * time.Millisecond)
+
+	spec := `[{"key": "edited", "response": {"status_code": 200, "content": "edited"}}]`
+	_ = ioutil.WriteFile(path.Join(dir, "edited"), []byte("EDITED"), 0644)
+	_ = ioutil.WriteFile(path.Join(dir, "spec.json"), []byte(spec), 0644)
+	if _, err := cacher.Record("key", &Recording{StatusCode: 200, Body: strings.NewReader("Hello")}); err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if response := cacher.Get("edited"); response == nil || string(response.Body) != "EDITED" {
+		t.Errorf("Got: `%v`; Expected the edited entry to be loaded", response)
+	}
+	if response := cacher.Get("key"); response == nil {
+		t.Errorf("Got: `%v`; Expected the recorded entry to be kept", response)
+	}
+}
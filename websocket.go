@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes, from RFC 6455
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+)
+
+// maxFrameSize is the largest WebSocket frame payload, in bytes, which will be proxied.
+const maxFrameSize = 64 << 20
+
+// closeTimeout is how long to wait for the other side of a connection to acknowledge a close frame.
+const closeTimeout = 5 * time.Second
+
+var errFrameTooLarge = errors.New("websocket frame is too large")
+
+// WebSocketFrame is a frame sent over a recorded WebSocket connection.
+type WebSocketFrame struct {
+	// FromClient is true for frames sent by the client, and false for frames sent by upstream
+	FromClient bool `json:"from_client,omitempty"`
+	Opcode     int  `json:"opcode"`
+	// Continued is true when more fragments of the message follow this frame
+	Continued bool   `json:"continued,omitempty"`
+	Payload   []byte `json:"payload"`
+	// Delay is the number of milliseconds between the connection opening and the frame
+	Delay int64 `json:"delay_ms"`
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Method == "GET" &&
+		headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept header value for a Sec-WebSocket-Key.
+func webSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// readFrame reads a single frame, returning it with its payload unmasked, along with the raw bytes read.
+func readFrame(r *bufio.Reader) (*WebSocketFrame, []byte, error) {
+	raw := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, nil, err
+	}
+	frame := &WebSocketFrame{
+		Continued: raw[0]&0x80 == 0,
+		Opcode:    int(raw[0] & 0x0f),
+	}
+	masked := raw[1]&0x80 != 0
+
+	length := uint64(raw[1] & 0x7f)
+	extra := 0
+	switch length {
+	case 126:
+		extra = 2
+	case 127:
+		extra = 8
+	}
+	if masked {
+		extra += 4
+	}
+	raw = raw[:2+extra]
+	if _, err := io.ReadFull(r, raw[2:]); err != nil {
+		return nil, nil, err
+	}
+	header := raw[2:]
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(header))
+		header = header[2:]
+	case 127:
+		length = binary.BigEndian.Uint64(header)
+		header = header[8:]
+	}
+	if length > maxFrameSize {
+		return nil, nil, errFrameTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	raw = append(raw, payload...)
+	frame.Payload = payload
+	if masked {
+		// Unmask a copy, leaving the raw frame untouched
+		frame.Payload = make([]byte, length)
+		for i := range payload {
+			frame.Payload[i] = payload[i] ^ header[i%4]
+		}
+	}
+	return frame, raw, nil
+}
+
+// writeFrame writes an unmasked frame, as sent by a server.
+func writeFrame(w io.Writer, frame *WebSocketFrame) error {
+	header := []byte{byte(frame.Opcode & 0x0f), 0}
+	if !frame.Continued {
+		header[0] |= 0x80
+	}
+	length := len(frame.Payload)
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(frame.Payload)
+	return err
+}
+
+// webSocketTranscript collects the frames sent in both directions over a connection.
+type webSocketTranscript struct {
+	start  time.Time
+	frames []WebSocketFrame
+	mutex  sync.Mutex
+}
+
+func (t *webSocketTranscript) add(frame *WebSocketFrame) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	frame.Delay = int64(time.Since(t.start) / time.Millisecond)
+	t.frames = append(t.frames, *frame)
+}
+
+// copyFrames copies frames from src to dst, adding each to transcript, until a close frame has been copied.
+func copyFrames(dst io.Writer, src *bufio.Reader, fromClient bool, transcript *webSocketTranscript) error {
+	for {
+		frame, raw, err := readFrame(src)
+		if err != nil {
+			return err
+		}
+		frame.FromClient = fromClient
+		transcript.add(frame)
+		if _, err = dst.Write(raw); err != nil {
+			return err
+		}
+		if frame.Opcode == wsOpClose {
+			return nil
+		}
+	}
+}
+
+// dialUpstream opens a connection to the host of u, using TLS for https and wss URLs.
+// The dialer, proxy, TLS configuration and handshake timeout of client's transport are used, if it has them.
+func dialUpstream(ctx context.Context, u *url.URL, client *http.Client) (net.Conn, error) {
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	host := hostPort(u.Host, secure)
+
+	dial := (&net.Dialer{}).DialContext
+	config := &tls.Config{}
+	var handshakeTimeout time.Duration
+	var proxyURL *url.URL
+	if transport, ok := client.Transport.(*http.Transport); ok {
+		if transport.DialContext != nil {
+			dial = transport.DialContext
+		}
+		if transport.TLSClientConfig != nil {
+			config = transport.TLSClientConfig.Clone()
+		}
+		handshakeTimeout = transport.TLSHandshakeTimeout
+		if transport.Proxy != nil {
+			// The proxy is chosen by the scheme of the HTTP request the upgrade started as
+			target := *u
+			target.Scheme = "http"
+			if secure {
+				target.Scheme = "https"
+			}
+			var err error
+			if proxyURL, err = transport.Proxy(&http.Request{URL: &target}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+	}
+
+	var conn net.Conn
+	var err error
+	if proxyURL != nil {
+		conn, err = dialProxy(ctx, dial, proxyURL, host)
+	} else {
+		conn, err = dial(ctx, "tcp", host)
+	}
+	if err != nil || !secure {
+		return conn, err
+	}
+
+	config.ServerName = u.Hostname()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		// If this fails, there isn't much to do
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// hostPort adds the default port to host, if it doesn't have one.
+func hostPort(host string, secure bool) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if secure {
+		return net.JoinHostPort(host, "443")
+	}
+	return net.JoinHostPort(host, "80")
+}
+
+// dialProxy opens a tunnel to host through an HTTP or HTTPS proxy, with CONNECT.
+func dialProxy(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	proxyURL *url.URL, host string) (net.Conn, error) {
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, fmt.Errorf("WebSocket connections through %v proxies are not supported", proxyURL.Scheme)
+	}
+	conn, err := dial(ctx, "tcp", hostPort(proxyURL.Host, proxyURL.Scheme == "https"))
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			// If this fails, there isn't much to do
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// If this fails, the CONNECT may take longer, which is harmless
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	reader := bufio.NewReader(conn)
+	err = connect.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(reader, connect)
+	}
+	if err == nil && resp.StatusCode != 200 {
+		err = fmt.Errorf("proxy %v refused to connect to %v: %v", proxyURL.Host, host, resp.Status)
+	}
+	if err != nil {
+		// If this fails, there isn't much to do
+		_ = conn.Close()
+		return nil, err
+	}
+	// The proxy may have sent some of the tunnelled data along with its response
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+func writeSwitchingProtocols(w io.Writer, header http.Header) error {
+	if _, err := io.WriteString(w, "HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return err
+	}
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// recordWebSocket proxies a WebSocket connection upstream, and stores the frames sent in both directions
+// in cacher once the connection closes.
+func recordWebSocket(w http.ResponseWriter, r *http.Request, hash string, cacher Cacher, upstreamClient *http.Client) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket connections are not supported", http.StatusInternalServerError)
+		return
+	}
+
+	upstream, err := dialUpstream(r.Context(), r.URL, upstreamClient)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		// If this fails, there isn't much to do
+		_ = upstream.Close()
+	}()
+	upstreamReader := bufio.NewReader(upstream)
+	if err = r.Write(upstream); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := http.ReadResponse(upstreamReader, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Upstream refused the upgrade, so pass its response on as-is
+		defer func() {
+			// If this fails, there isn't much to do
+			_ = resp.Body.Close()
+		}()
+		copyHeaders(w.Header(), resp.Header)
+		w.Header().Add("chameleon-request-hash", hash)
+		w.Header().Set("chameleon-cache", cacheMiss)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+
+	client, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("-> Unable to proxy WebSocket [%v]: %v\n", hash, err)
+		return
+	}
+	defer func() {
+		// If this fails, there isn't much to do
+		_ = client.Close()
+	}()
+
+	header := make(http.Header)
+	copyHeaders(header, resp.Header)
+	header.Add("chameleon-request-hash", hash)
+	header.Set("chameleon-cache", cacheMiss)
+	if err = writeSwitchingProtocols(client, header); err != nil {
+		log.Printf("-> Unable to proxy WebSocket [%v]: %v\n", hash, err)
+		return
+	}
+
+	transcript := &webSocketTranscript{start: time.Now()}
+	var once sync.Once
+	closing := func(err error) {
+		once.Do(func() {
+			if err != nil {
+				// One side went away, so the connection is over
+				_ = client.Close()
+				_ = upstream.Close()
+				return
+			}
+			// Give the other side a chance to acknowledge the close frame
+			deadline := time.Now().Add(closeTimeout)
+			_ = client.SetDeadline(deadline)
+			_ = upstream.SetDeadline(deadline)
+		})
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		closing(copyFrames(upstream, clientBuf.Reader, true, transcript))
+	}()
+	go func() {
+		defer wg.Done()
+		closing(copyFrames(client, upstreamReader, false, transcript))
+	}()
+	wg.Wait()
+
+	_, err = cacher.Record(hash, &Recording{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       strings.NewReader(""),
+		Frames:     transcript.frames,
+	})
+	if err != nil {
+		log.Printf("-> Unable to record [%v]: %v\n", hash, err)
+	}
+}
+
+// replayWebSocket accepts a WebSocket connection and replays a recorded transcript: each recorded
+// client frame waits for the client to send a frame, and upstream frames are sent with their original
+// delays, scaled by scale.
+func replayWebSocket(w http.ResponseWriter, r *http.Request, hash string, response *CachedResponse, scale float64) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket connections are not supported", http.StatusInternalServerError)
+		return
+	}
+	client, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("-> Unable to replay WebSocket [%v]: %v\n", hash, err)
+		return
+	}
+	defer func() {
+		// If this fails, there isn't much to do
+		_ = client.Close()
+	}()
+
+	header := make(http.Header)
+	for k, v := range response.Headers {
+		header.Add(k, v)
+	}
+	header.Set("Sec-WebSocket-Accept", webSocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+	header.Add("chameleon-request-hash", hash)
+	header.Set("chameleon-cache", cacheStatus(response))
+	if err = writeSwitchingProtocols(client, header); err != nil {
+		return
+	}
+
+	closed := false
+	last := int64(0)
+	lastTime := time.Now()
+	for i := range response.Frames {
+		frame := &response.Frames[i]
+		if frame.FromClient {
+			received, _, err := readFrame(clientBuf.Reader)
+			if err != nil {
+				return
+			}
+			if received.Opcode == wsOpClose {
+				if !closed {
+					_ = writeFrame(client, &WebSocketFrame{Opcode: wsOpClose, Payload: received.Payload})
+				}
+				return
+			}
+		} else {
+			delay := time.Duration(float64(frame.Delay-last)*scale) * time.Millisecond
+			time.Sleep(delay - time.Since(lastTime))
+			if err = writeFrame(client, frame); err != nil {
+				return
+			}
+			closed = closed || frame.Opcode == wsOpClose
+		}
+		last, lastTime = frame.Delay, time.Now()
+	}
+
+	if !closed {
+		// Normal closure
+		_ = writeFrame(client, &WebSocketFrame{Opcode: wsOpClose, Payload: []byte{0x03, 0xe8}})
+	}
+	// Wait briefly for the client to acknowledge the close
+	_ = client.SetReadDeadline(time.Now().Add(closeTimeout))
+	for {
+		received, _, err := readFrame(clientBuf.Reader)
+		if err != nil || received.Opcode == wsOpClose {
+			return
+		}
+	}
+}
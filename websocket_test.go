@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoWebSocket is an upstream which greets each connection, then echoes text frames in upper case.
+func echoWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	header := http.Header{
+		"Upgrade":              {"websocket"},
+		"Connection":           {"Upgrade"},
+		"Sec-Websocket-Accept": {webSocketAccept(r.Header.Get("Sec-WebSocket-Key"))},
+	}
+	_ = writeSwitchingProtocols(conn, header)
+	_ = writeFrame(conn, &WebSocketFrame{Opcode: wsOpText, Payload: []byte("hello")})
+	for {
+		frame, _, err := readFrame(buf.Reader)
+		if err != nil {
+			return
+		}
+		if frame.Opcode == wsOpClose {
+			_ = writeFrame(conn, frame)
+			return
+		}
+		_ = writeFrame(conn, &WebSocketFrame{Opcode: wsOpText, Payload: bytes.ToUpper(frame.Payload)})
+	}
+}
+
+// dialWebSocket opens a WebSocket connection to url, returning the connection and the handshake response.
+func dialWebSocket(t *testing.T, serverURL string) (net.Conn, *bufio.Reader, *http.Response) {
+	u, _ := url.Parse(serverURL)
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	fmt.Fprintf(conn, "GET /socket HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", u.Host)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Got: `%v`; Expected: `101`", resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Got: `%v`; Expected: `s3pPLMBiTxaQ9kYGzzhZRbK+xOo=`", accept)
+	}
+	return conn, reader, resp
+}
+
+// writeClientFrame writes a masked frame, as sent by a client.
+func writeClientFrame(conn net.Conn, opcode int, payload string) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | byte(opcode), 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	_, _ = conn.Write(frame)
+}
+
+func readText(t *testing.T, reader *bufio.Reader, expected string) {
+	frame, _, err := readFrame(reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: `%v`", err)
+	}
+	if frame.Opcode != wsOpText || string(frame.Payload) != expected {
+		t.Errorf("Got: `%v %q`; Expected: `%v %q`", frame.Opcode, frame.Payload, wsOpText, expected)
+	}
+}
+
+// notifyingCacher signals on recorded once each response has been recorded.
+type notifyingCacher struct {
+	mockCacher
+	recorded chan string
+}
+
+func (c notifyingCacher) Record(key string, rec *Recording) (*CachedResponse, error) {
+	response, err := c.mockCacher.Record(key, rec)
+	c.recorded <- key
+	return response, err
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/socket", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if !isWebSocketUpgrade(req) {
+		t.Errorf("Expected a WebSocket upgrade")
+	}
+	req.Header.Set("Upgrade", "h2c")
+	if isWebSocketUpgrade(req) {
+		t.Errorf("Expected no WebSocket upgrade")
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 70000} {
+		payload := strings.Repeat("x", size)
+		var buf bytes.Buffer
+		_ = writeFrame(&buf, &WebSocketFrame{Opcode: wsOpText, Continued: true, Payload: []byte(payload)})
+		raw := buf.String()
+		frame, read, err := readFrame(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatalf("Unexpected error: `%v`", err)
+		}
+		if string(frame.Payload) != payload || !frame.Continued || string(read) != raw {
+			t.Errorf("Got: `%v` byte frame; Expected the %v byte frame to round trip", len(frame.Payload), size)
+		}
+	}
+}
+
+func TestCachedProxyHandlerRecordsWebSocket(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(echoWebSocket))
+	defer upstream.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	cache := notifyingCacher{mockCacher{data: make(map[string]*CachedResponse)}, make(chan string, 1)}
+	server := httptest.NewServer(CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{}))
+	defer server.Close()
+
+	conn, reader, resp := dialWebSocket(t, server.URL)
+	hash := resp.Header.Get("chameleon-request-hash")
+	readText(t, reader, "hello")
+	writeClientFrame(conn, wsOpText, "ping")
+	readText(t, reader, "PING")
+	writeClientFrame(conn, wsOpClose, "")
+	if frame, _, err := readFrame(reader); err != nil || frame.Opcode != wsOpClose {
+		t.Errorf("Got: `%v`; Expected a close frame", err)
+	}
+	conn.Close()
+
+	select {
+	case <-cache.recorded:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the WebSocket connection to be recorded")
+	}
+	response := cache.Get(hash)
+	var transcript []string
+	for _, frame := range response.Frames {
+		transcript = append(transcript, fmt.Sprintf("%v:%v:%s", frame.FromClient, frame.Opcode, frame.Payload))
+	}
+	expected := "false:1:hello true:1:ping false:1:PING true:8: false:8:"
+	if strings.Join(transcript, " ") != expected {
+		t.Errorf("Got: `%v`; Expected: `%v`", strings.Join(transcript, " "), expected)
+	}
+
+	// Replay without upstream
+	upstream.Close()
+	conn, reader, _ = dialWebSocket(t, server.URL)
+	defer conn.Close()
+	readText(t, reader, "hello")
+	writeClientFrame(conn, wsOpText, "anything")
+	readText(t, reader, "PING")
+	writeClientFrame(conn, wsOpClose, "")
+	if frame, _, err := readFrame(reader); err != nil || frame.Opcode != wsOpClose {
+		t.Errorf("Got: `%v`; Expected a close frame", err)
+	}
+}
+
+// connectProxy tunnels CONNECT requests, and sends each target it was asked for on targets.
+func connectProxy(targets chan<- string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		targets <- r.Host
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			_, _ = io.Copy(upstream, buf)
+			upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		conn.Close()
+	})
+}
+
+func TestCachedProxyHandlerRecordsWebSocketThroughProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(echoWebSocket))
+	defer upstream.Close()
+	targets := make(chan string, 1)
+	proxy := httptest.NewServer(connectProxy(targets))
+	defer proxy.Close()
+
+	serverURL, _ := url.Parse(upstream.URL)
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	cache := notifyingCacher{mockCacher{data: make(map[string]*CachedResponse)}, make(chan string, 1)}
+	server := httptest.NewServer(CachedProxyHandler(serverURL, cache, DefaultHasher{}, ProxyOptions{Client: client}))
+	defer server.Close()
+
+	conn, reader, _ := dialWebSocket(t, server.URL)
+	defer conn.Close()
+	readText(t, reader, "hello")
+
+	select {
+	case target := <-targets:
+		if target != serverURL.Host {
+			t.Errorf("Got: `%v`; Expected: `%v`", target, serverURL.Host)
+		}
+	default:
+		t.Errorf("Got: no CONNECT; Expected: `%v`", serverURL.Host)
+	}
+}
+
+func TestDialUpstreamProxyErrors(t *testing.T) {
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer refusing.Close()
+	refusingURL, _ := url.Parse(refusing.URL)
+	socksURL, _ := url.Parse("socks5://127.0.0.1:1080")
+
+	target, _ := url.Parse("ws://example.com/socket")
+	for _, proxyURL := range []*url.URL{refusingURL, socksURL} {
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		conn, err := dialUpstream(context.Background(), target, client)
+		if err == nil {
+			conn.Close()
+			t.Errorf("Got: `%v`; Expected an error for proxy %v", err, proxyURL)
+		}
+	}
+}